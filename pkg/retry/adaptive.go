@@ -0,0 +1,51 @@
+package retry
+
+import "sync"
+
+const (
+	// adaptiveWindow is the number of recent attempts from which an adaptive
+	// Retryer computes the success rate.
+	adaptiveWindow = 20
+	// maxAdaptiveMultiplier is the factor applied to the delays of an
+	// adaptive Retryer once all the recent attempts failed.
+	maxAdaptiveMultiplier = 8
+)
+
+// outcomes records whether the recent attempts of the operations of an
+// adaptive Retryer failed.
+type outcomes struct {
+	mu       sync.Mutex
+	failed   [adaptiveWindow]bool
+	n        int // The number of attempts recorded, up to adaptiveWindow.
+	next     int // The index in failed of the next attempt.
+	failures int // The number of failed attempts in the window.
+}
+
+// record adds an attempt to the window, replacing the oldest one if full.
+func (o *outcomes) record(failed bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.n == adaptiveWindow && o.failed[o.next] {
+		o.failures--
+	}
+	if o.n < adaptiveWindow {
+		o.n++
+	}
+	o.failed[o.next] = failed
+	if failed {
+		o.failures++
+	}
+	o.next = (o.next + 1) % adaptiveWindow
+}
+
+// multiplier returns the factor to apply to the delays, from 1 if no recent
+// attempt failed to maxAdaptiveMultiplier if all of them failed, in
+// proportion to the failure rate.
+func (o *outcomes) multiplier() float64 {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.n == 0 {
+		return 1
+	}
+	return 1 + (maxAdaptiveMultiplier-1)*float64(o.failures)/float64(o.n)
+}
@@ -0,0 +1,291 @@
+package retry
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffStrategy determines how the delay between retries is computed.
+type BackoffStrategy int
+
+const (
+	// BackoffExponential waits BaseDelay * Factor^attempt, randomized to
+	// [0, delay) if Jitter is set.
+	BackoffExponential BackoffStrategy = iota
+	// BackoffFullJitter waits a random duration in [0, BaseDelay * Factor^attempt),
+	// i.e. BackoffExponential with Jitter always set.
+	BackoffFullJitter
+	// BackoffDecorrelated waits a random duration in [BaseDelay, 3 * previous
+	// delay), the "decorrelated jitter" algorithm.  It spreads retries like
+	// full jitter without repeatedly picking very short delays.
+	BackoffDecorrelated
+	// BackoffLinear waits BaseDelay * (attempt + 1), randomized to
+	// [0, delay) if Jitter is set.
+	BackoffLinear
+	// BackoffConstant waits BaseDelay before every retry, randomized to
+	// [0, BaseDelay) if Jitter is set.
+	BackoffConstant
+	// BackoffFibonacci waits BaseDelay * fib(attempt), i.e. 1, 1, 2, 3, 5, 8...
+	// times BaseDelay, randomized to [0, delay) if Jitter is set.  It grows
+	// slower than BackoffExponential but faster than BackoffLinear.
+	BackoffFibonacci
+)
+
+const (
+	defaultBaseDelay = time.Second
+	defaultFactor    = 2
+	// defaultEquilibriumJitter is the EquilibriumJitter used if Jitter only
+	// applies to the first attempt.
+	defaultEquilibriumJitter = 0.1
+)
+
+// nextDelay returns the delay to wait before the retry following attempt,
+// prev being the delay waited before that attempt (0 for the first one).
+// The result never exceeds MaxDelay, if set.  A nil rng uses the
+// package-level source of math/rand.
+func nextDelay(attempt int, prev time.Duration, options *Options, rng *rand.Rand) time.Duration {
+	var delay time.Duration
+	switch options.Strategy {
+	case BackoffDecorrelated:
+		if options.Delay != 0 {
+			delay = options.Delay
+			break
+		}
+		base := options.baseDelay()
+		if prev < base {
+			prev = base
+		}
+		delay = base + jitter(saturate(3*float64(prev))-base, rng)
+	case BackoffFullJitter:
+		delay = options.fullJitter(options.backoff(attempt), rng)
+	default:
+		delay = options.backoff(attempt)
+		if options.jitterRetries() {
+			delay = options.fullJitter(delay, rng)
+		} else if options.RandomizationFactor > 0 {
+			low, width := options.randomizationBand(delay)
+			delay = low + jitter(width, rng)
+		}
+	}
+	if options.MaxDelay > 0 && delay > options.MaxDelay {
+		delay = options.MaxDelay
+	}
+	if options.plateaued(attempt) {
+		low, width := options.equilibriumBand()
+		delay = low + jitter(width, rng)
+	}
+	return delay
+}
+
+// plateaued returns true if the backoff before the retry following attempt
+// has reached MaxDelay, and is randomized according to EquilibriumJitter.
+func (o *Options) plateaued(attempt int) bool {
+	return o.equilibriumJitter() > 0 && o.MaxDelay > 0 && o.Strategy != BackoffDecorrelated && o.backoff(attempt) >= o.MaxDelay
+}
+
+// equilibriumJitter returns EquilibriumJitter, or its default if Jitter is
+// set but does not apply to the retries, so that delays clamped to MaxDelay
+// are not synchronized across clients.
+func (o *Options) equilibriumJitter() float64 {
+	if o.EquilibriumJitter == 0 && o.Jitter && o.JitterFirstAttemptOnly && o.Strategy != BackoffFullJitter {
+		return defaultEquilibriumJitter
+	}
+	return o.EquilibriumJitter
+}
+
+// equilibriumBand returns the lower bound and the width of the range of
+// delays used once the backoff has plateaued.
+func (o *Options) equilibriumBand() (time.Duration, time.Duration) {
+	return band(o.MaxDelay, o.equilibriumJitter())
+}
+
+// DelaySchedule returns the delays waited before each of the retries allowed
+// by MaxRetry or MaxAttempts, e.g. to log or test a configuration.  For
+// randomized strategies, or if Jitter or RandomizationFactor are set, the
+// delays are the upper bounds of the random ones.  Delays provided by
+// RetryAfter or DelayForError depend on the errors, and are not included.
+func (o *Options) DelaySchedule() []time.Duration {
+	if o == nil {
+		return nil
+	}
+	maxRetry, _ := o.maxRetry()
+	if maxRetry <= 0 {
+		return nil
+	}
+	schedule := make([]time.Duration, 0, maxRetry)
+	bound := o.baseDelay()
+	for retry := 0; retry < maxRetry; retry++ {
+		if retry < o.ImmediateAttempts {
+			schedule = append(schedule, 0)
+			continue
+		}
+		attempt := retry - o.ImmediateAttempts
+		delay := o.backoff(attempt)
+		if o.Strategy == BackoffDecorrelated && o.Delay == 0 {
+			if bound > math.MaxInt64/3 {
+				bound = math.MaxInt64
+			} else {
+				bound *= 3
+			}
+			if o.MaxDelay > 0 && bound > o.MaxDelay {
+				bound = o.MaxDelay
+			}
+			delay = bound
+		}
+		if o.RandomizationFactor > 0 && !o.jitterRetries() && o.Strategy != BackoffFullJitter && o.Strategy != BackoffDecorrelated {
+			low, width := o.randomizationBand(delay)
+			delay = low + width
+			if o.MaxDelay > 0 && delay > o.MaxDelay {
+				delay = o.MaxDelay
+			}
+		}
+		if o.plateaued(attempt) {
+			low, width := o.equilibriumBand()
+			delay = low + width
+		}
+		schedule = append(schedule, delay)
+	}
+	return schedule
+}
+
+// randomizationBand returns the lower bound and the width of the range of
+// delays RandomizationFactor picks from around delay.
+func (o *Options) randomizationBand(delay time.Duration) (time.Duration, time.Duration) {
+	return band(delay, o.RandomizationFactor)
+}
+
+// band returns the lower bound and the width of the range of delays within
+// fraction of delay around it.  The range is computed in float64, and
+// truncated at the largest time.Duration so that the lower bound plus the
+// width never overflows, even for saturated delays.
+func band(delay time.Duration, fraction float64) (time.Duration, time.Duration) {
+	spread := float64(delay) * fraction
+	low := saturate(float64(delay) - spread)
+	width := saturate(2 * spread)
+	if width > math.MaxInt64-low {
+		width = math.MaxInt64 - low
+	}
+	return low, width
+}
+
+// backoff returns the jitter-free delay to wait before the retry following attempt.
+// Unless a fixed Delay is set, it is BaseDelay * Factor^attempt, or
+// BaseDelay * (attempt + 1) for BackoffLinear, or BaseDelay for
+// BackoffConstant, or BaseDelay * fib(attempt) for BackoffFibonacci, capped
+// at MaxDelay.  AttemptOffset is added to attempt in these formulas.
+func (o *Options) backoff(attempt int) time.Duration {
+	if o.Delay != 0 {
+		return o.Delay
+	}
+	attempt += o.AttemptOffset
+	factor := o.Factor
+	if factor == 0 {
+		factor = defaultFactor
+	}
+	var delay time.Duration
+	switch o.Strategy {
+	case BackoffLinear:
+		delay = saturate(float64(o.baseDelay()) * float64(attempt+1))
+	case BackoffConstant:
+		delay = o.baseDelay()
+	case BackoffFibonacci:
+		delay = fibonacci(o.baseDelay(), attempt, o.MaxDelay)
+	default:
+		delay = saturate(float64(o.baseDelay()) * math.Pow(factor, float64(attempt)))
+	}
+	if o.MaxDelay > 0 && delay > o.MaxDelay {
+		delay = o.MaxDelay
+	}
+	return delay
+}
+
+// saturate converts delay to a time.Duration, saturating at the largest
+// time.Duration instead of overflowing.
+func saturate(delay float64) time.Duration {
+	if delay >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+// fibonacci returns base * fib(attempt), fib(0) and fib(1) being 1.  The
+// sequence is computed iteratively and stops growing once it reaches
+// maxDelay, if positive, or the largest time.Duration, so it never overflows.
+func fibonacci(base time.Duration, attempt int, maxDelay time.Duration) time.Duration {
+	limit := time.Duration(math.MaxInt64)
+	if maxDelay > 0 {
+		limit = maxDelay
+	}
+	prev, delay := base, base
+	for i := 1; i < attempt && delay < limit; i++ {
+		if prev > limit-delay {
+			return limit
+		}
+		prev, delay = delay, prev+delay
+	}
+	return delay
+}
+
+// baseDelay returns BaseDelay, or its default if not set.
+func (o *Options) baseDelay() time.Duration {
+	if o.BaseDelay == 0 {
+		return defaultBaseDelay
+	}
+	return o.BaseDelay
+}
+
+// jitterRetries returns true if Jitter applies to the delays between retries.
+func (o *Options) jitterRetries() bool {
+	return o.Jitter && !o.JitterFirstAttemptOnly
+}
+
+// randomized returns true if the computed delays, or the sampling of log
+// messages, involve randomness.
+func (o *Options) randomized() bool {
+	return o.Jitter || o.RandomizationFactor > 0 || o.EquilibriumJitter > 0 || o.LogSampleRate > 1 || o.Strategy == BackoffFullJitter || o.Strategy == BackoffDecorrelated
+}
+
+// randMu serializes the use of the Rand of all Options.
+var randMu sync.Mutex
+
+// newRand returns the random source to use for a single retry loop, nil
+// standing for the package-level source of math/rand if Rand is not set.
+func (o *Options) newRand() *rand.Rand {
+	if o.Rand == nil {
+		return nil
+	}
+	randMu.Lock()
+	defer randMu.Unlock()
+	return rand.New(rand.NewSource(o.Rand.Int63()))
+}
+
+// fullJitter returns a random duration in [0, delay), or in
+// [delay - MaxJitter, delay) if MaxJitter is set and smaller than delay.
+func (o *Options) fullJitter(delay time.Duration, rng *rand.Rand) time.Duration {
+	if o.MaxJitter > 0 && delay > o.MaxJitter {
+		return delay - o.MaxJitter + jitter(o.MaxJitter, rng)
+	}
+	return jitter(delay, rng)
+}
+
+// jitter returns a random duration in [0, delay).
+func jitter(delay time.Duration, rng *rand.Rand) time.Duration {
+	if delay <= 0 {
+		return 0
+	}
+	if rng == nil {
+		return time.Duration(rand.Int63n(int64(delay)))
+	}
+	return time.Duration(rng.Int63n(int64(delay)))
+}
+
+// intn returns a random int in [0, n) from rng, or from the package-level
+// source of math/rand if rng is nil.
+func intn(n int, rng *rand.Rand) int {
+	if rng == nil {
+		return rand.Intn(n)
+	}
+	return rng.Intn(n)
+}
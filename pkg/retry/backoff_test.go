@@ -0,0 +1,437 @@
+package retry
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRand(t *testing.T) {
+	delays := func(rng *rand.Rand) []time.Duration {
+		clock := newFakeClock()
+		err := IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, &Options{MaxRetry: 5, Strategy: BackoffFullJitter, BaseDelay: time.Second, Rand: rng, Clock: clock})
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		return clock.Slept()
+	}
+	// A seeded source yields the same delays again.
+	first := delays(rand.New(rand.NewSource(1)))
+	require.Equal(t, first, delays(rand.New(rand.NewSource(1))))
+	require.NotEqual(t, first, delays(rand.New(rand.NewSource(2))))
+
+	// Concurrent retry loops can share a source, e.g. with go test -race.
+	shared := rand.New(rand.NewSource(1))
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Len(t, delays(shared), 5)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestJitter(t *testing.T) {
+	options := Options{
+		BaseDelay: 100 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Jitter:    true,
+		Rand:      rand.New(rand.NewSource(1)),
+	}
+	rng := options.newRand()
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := jitter(options.backoff(attempt), rng)
+		require.GreaterOrEqual(t, delay, time.Duration(0))
+		require.Less(t, delay, options.MaxDelay)
+	}
+
+	// An injected source must yield the same sequence again.
+	first := jitter(time.Second, rand.New(rand.NewSource(42)))
+	second := jitter(time.Second, rand.New(rand.NewSource(42)))
+	require.Equal(t, first, second)
+
+	require.Equal(t, time.Duration(0), jitter(0, rng))
+
+	// Without Rand, the package-level source of math/rand is used.
+	require.Nil(t, (&Options{Jitter: true}).newRand())
+	for attempt := 0; attempt < 10; attempt++ {
+		delay := jitter(time.Second, nil)
+		require.GreaterOrEqual(t, delay, time.Duration(0))
+		require.Less(t, delay, time.Second)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		options *Options
+		delays  []time.Duration
+	}{
+		{&Options{}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{&Options{BaseDelay: 50 * time.Millisecond, Factor: 1.5}, []time.Duration{50 * time.Millisecond, 75 * time.Millisecond, 112500 * time.Microsecond, 168750 * time.Microsecond}},
+		{&Options{BaseDelay: 50 * time.Millisecond}, []time.Duration{50 * time.Millisecond, 100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond}},
+		{&Options{Factor: 3}, []time.Duration{time.Second, 3 * time.Second, 9 * time.Second, 27 * time.Second}},
+		{&Options{BaseDelay: 50 * time.Millisecond, Factor: 1.5, MaxDelay: 100 * time.Millisecond}, []time.Duration{50 * time.Millisecond, 75 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}},
+		{&Options{MaxDelay: 5 * time.Second}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}},
+		{&Options{Delay: time.Minute, BaseDelay: 50 * time.Millisecond, Factor: 1.5}, []time.Duration{time.Minute, time.Minute, time.Minute, time.Minute}},
+	} {
+		var delays []time.Duration
+		for attempt := 0; attempt < len(tc.delays); attempt++ {
+			delays = append(delays, tc.options.backoff(attempt))
+		}
+		require.Equal(t, tc.delays, delays, "%+v", tc.options)
+	}
+}
+
+func TestNextDelay(t *testing.T) {
+	t.Run("exponential", func(t *testing.T) {
+		options := &Options{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+		var delays []time.Duration
+		for attempt := 0; attempt < 6; attempt++ {
+			delays = append(delays, nextDelay(attempt, 0, options, nil))
+		}
+		require.Equal(t, []time.Duration{
+			100 * time.Millisecond,
+			200 * time.Millisecond,
+			400 * time.Millisecond,
+			800 * time.Millisecond,
+			time.Second,
+			time.Second,
+		}, delays)
+	})
+
+	t.Run("exponential factor", func(t *testing.T) {
+		options := &Options{BaseDelay: 50 * time.Millisecond, Factor: 1.5}
+		require.Equal(t, 50*time.Millisecond, nextDelay(0, 0, options, nil))
+		require.Equal(t, 75*time.Millisecond, nextDelay(1, 0, options, nil))
+		require.Equal(t, 112500*time.Microsecond, nextDelay(2, 0, options, nil))
+	})
+
+	t.Run("linear", func(t *testing.T) {
+		options := &Options{Strategy: BackoffLinear, BaseDelay: 2 * time.Second, MaxDelay: 7 * time.Second}
+		var delays []time.Duration
+		for attempt := 0; attempt < 5; attempt++ {
+			delays = append(delays, nextDelay(attempt, 0, options, nil))
+		}
+		require.Equal(t, []time.Duration{
+			2 * time.Second,
+			4 * time.Second,
+			6 * time.Second,
+			7 * time.Second,
+			7 * time.Second,
+		}, delays)
+	})
+
+	t.Run("full jitter", func(t *testing.T) {
+		options := &Options{Strategy: BackoffFullJitter, BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+		rng := rand.New(rand.NewSource(1))
+		for attempt := 0; attempt < 10; attempt++ {
+			delay := nextDelay(attempt, 0, options, rng)
+			require.GreaterOrEqual(t, delay, time.Duration(0))
+			require.Less(t, delay, options.backoff(attempt))
+		}
+	})
+
+	t.Run("decorrelated", func(t *testing.T) {
+		options := &Options{Strategy: BackoffDecorrelated, BaseDelay: 100 * time.Millisecond, MaxDelay: 5 * time.Second}
+		rng := rand.New(rand.NewSource(1))
+		prev := time.Duration(0)
+		for attempt := 0; attempt < 20; attempt++ {
+			delay := nextDelay(attempt, prev, options, rng)
+			require.GreaterOrEqual(t, delay, options.BaseDelay)
+			require.LessOrEqual(t, delay, options.MaxDelay)
+			if prev > 0 {
+				require.Less(t, delay, 3*prev)
+			}
+			prev = delay
+		}
+	})
+}
+
+func TestSubSecondDelays(t *testing.T) {
+	// The delays are derived from BaseDelay, in whatever unit it uses.
+	for _, tc := range []struct {
+		options *Options
+		delays  []time.Duration
+	}{
+		{&Options{BaseDelay: time.Millisecond}, []time.Duration{time.Millisecond, 2 * time.Millisecond, 4 * time.Millisecond, 8 * time.Millisecond}},
+		{&Options{BaseDelay: 250 * time.Microsecond, Factor: 1.5}, []time.Duration{250 * time.Microsecond, 375 * time.Microsecond, 562500 * time.Nanosecond, 843750 * time.Nanosecond}},
+		{&Options{BaseDelay: 10 * time.Millisecond, Strategy: BackoffLinear}, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond, 40 * time.Millisecond}},
+		{&Options{BaseDelay: 5 * time.Millisecond, MaxDelay: 12 * time.Millisecond}, []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 12 * time.Millisecond, 12 * time.Millisecond}},
+	} {
+		clock := newFakeClock()
+		tc.options.MaxRetry = 4
+		tc.options.Clock = clock
+		err := IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, tc.options)
+		require.True(t, IsExhausted(err))
+		require.Equal(t, tc.delays, clock.Slept(), "%+v", tc.options)
+	}
+}
+
+func TestBackoffConstant(t *testing.T) {
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 4, Strategy: BackoffConstant, BaseDelay: 500 * time.Millisecond, Clock: clock})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, []time.Duration{
+		500 * time.Millisecond,
+		500 * time.Millisecond,
+		500 * time.Millisecond,
+		500 * time.Millisecond,
+	}, clock.Slept())
+
+	options := &Options{Strategy: BackoffConstant, BaseDelay: 500 * time.Millisecond, Jitter: true}
+	rng := rand.New(rand.NewSource(1))
+	for attempt := 0; attempt < 10; attempt++ {
+		require.Less(t, nextDelay(attempt, 0, options, rng), options.BaseDelay)
+	}
+}
+
+func TestBackoffFibonacci(t *testing.T) {
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 8, Strategy: BackoffFibonacci, BaseDelay: 100 * time.Millisecond, Clock: clock})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	var expected []time.Duration
+	for _, fib := range []time.Duration{1, 1, 2, 3, 5, 8, 13, 21} {
+		expected = append(expected, fib*100*time.Millisecond)
+	}
+	require.Equal(t, expected, clock.Slept())
+
+	options := &Options{Strategy: BackoffFibonacci, MaxDelay: time.Minute}
+	require.Equal(t, time.Minute, options.backoff(20))
+	require.Equal(t, time.Minute, options.backoff(math.MaxInt32))
+	options.MaxDelay = 0
+	require.Equal(t, time.Duration(math.MaxInt64), options.backoff(200))
+}
+
+func TestDelaySchedule(t *testing.T) {
+	for _, tc := range []struct {
+		options  *Options
+		expected []time.Duration
+	}{
+		{nil, nil},
+		{&Options{}, nil},
+		{&Options{MaxRetry: 4}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{&Options{MaxRetry: 4, MaxDelay: 3 * time.Second, Jitter: true}, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}},
+		{&Options{MaxRetry: 3, Delay: time.Minute}, []time.Duration{time.Minute, time.Minute, time.Minute}},
+		{&Options{MaxRetry: 3, Strategy: BackoffLinear, BaseDelay: time.Millisecond}, []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}},
+		{&Options{MaxRetry: 3, Strategy: BackoffFullJitter}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{&Options{MaxRetry: 4, Strategy: BackoffDecorrelated, MaxDelay: 20 * time.Second}, []time.Duration{3 * time.Second, 9 * time.Second, 20 * time.Second, 20 * time.Second}},
+	} {
+		require.Equal(t, tc.expected, tc.options.DelaySchedule(), "%+v", tc.options)
+	}
+
+	// The actual delays match the schedule.
+	options := &Options{MaxRetry: 5, BaseDelay: 100 * time.Millisecond, Factor: 3, MaxDelay: 5 * time.Second, Clock: newFakeClock()}
+	_ = IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, options)
+	require.Equal(t, options.DelaySchedule(), options.Clock.(*fakeClock).Slept())
+}
+
+func TestEquilibriumJitter(t *testing.T) {
+	options := &Options{MaxDelay: 10 * time.Second, EquilibriumJitter: 0.2, Jitter: true}
+	rng := rand.New(rand.NewSource(1))
+	for attempt := 0; attempt < 100; attempt++ {
+		delay := nextDelay(attempt, 0, options, rng)
+		if attempt < 4 { // 1s, 2s, 4s, 8s
+			require.Less(t, delay, options.backoff(attempt))
+			continue
+		}
+		require.GreaterOrEqual(t, delay, 8*time.Second)
+		require.Less(t, delay, 12*time.Second)
+	}
+
+	options.Jitter = false
+	for attempt := 0; attempt < 4; attempt++ {
+		require.Equal(t, options.backoff(attempt), nextDelay(attempt, 0, options, rng))
+	}
+	options.MaxRetry = 6
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 12 * time.Second, 12 * time.Second}, options.DelaySchedule())
+}
+
+func TestMaxDelaySpread(t *testing.T) {
+	// Clients whose delays reached MaxDelay do not retry in the same wave.
+	for _, options := range []*Options{
+		NewOptions(WithMaxRetry(8), WithMaxDelay(10*time.Second), WithMaxDelayJitterSpread(0.2)),
+		{MaxRetry: 8, MaxDelay: 10 * time.Second, Jitter: true, JitterFirstAttemptOnly: true},
+	} {
+		spread := options.equilibriumJitter()
+		require.Greater(t, spread, 0.0)
+		clamped := map[time.Duration]bool{}
+		for seed := int64(0); seed < 50; seed++ {
+			clock := newFakeClock()
+			client := *options
+			client.Rand = rand.New(rand.NewSource(seed))
+			client.Clock = clock
+			_ = IfNecessary(context.Background(), func() error {
+				return syscall.ECONNRESET
+			}, &client)
+			slept := clock.Slept()
+			if options.JitterFirstAttemptOnly {
+				slept = slept[1:] // The randomized start
+			}
+			require.Len(t, slept, 8)
+			// The delays below MaxDelay are predictable.
+			require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, slept[:4])
+			for _, delay := range slept[4:] {
+				require.GreaterOrEqual(t, delay, time.Duration(float64(10*time.Second)*(1-spread)))
+				require.Less(t, delay, time.Duration(float64(10*time.Second)*(1+spread)))
+				clamped[delay] = true
+			}
+		}
+		require.Greater(t, len(clamped), 100, "%+v", options)
+	}
+
+	// Jitter applied to the retries already spreads them.
+	require.Zero(t, (&Options{MaxDelay: time.Second, Jitter: true}).equilibriumJitter())
+	require.Zero(t, (&Options{MaxDelay: time.Second, Jitter: true, JitterFirstAttemptOnly: true, Strategy: BackoffFullJitter}).equilibriumJitter())
+}
+
+func TestAttemptOffset(t *testing.T) {
+	for _, tc := range []struct {
+		options  *Options
+		expected []time.Duration
+	}{
+		{&Options{MaxRetry: 3, AttemptOffset: 0}, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{&Options{MaxRetry: 3, AttemptOffset: 1}, []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second}},
+		{&Options{MaxRetry: 3, AttemptOffset: 2, Factor: 3}, []time.Duration{9 * time.Second, 27 * time.Second, 81 * time.Second}},
+		{&Options{MaxRetry: 3, AttemptOffset: 1, Strategy: BackoffLinear}, []time.Duration{2 * time.Second, 3 * time.Second, 4 * time.Second}},
+		{&Options{MaxRetry: 3, AttemptOffset: 1, Strategy: BackoffConstant}, []time.Duration{time.Second, time.Second, time.Second}},
+		{&Options{MaxRetry: 3, AttemptOffset: 5, MaxDelay: 10 * time.Second}, []time.Duration{10 * time.Second, 10 * time.Second, 10 * time.Second}},
+	} {
+		clock := newFakeClock()
+		tc.options.Clock = clock
+		_ = IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, tc.options)
+		require.Equal(t, tc.expected, clock.Slept(), "%+v", tc.options)
+	}
+	require.Error(t, (&Options{AttemptOffset: -1}).Validate())
+}
+
+func TestImmediateAttempts(t *testing.T) {
+	for _, tc := range []struct {
+		options  *Options
+		expected []time.Duration
+	}{
+		{&Options{MaxRetry: 5, ImmediateAttempts: 2}, []time.Duration{0, 0, time.Second, 2 * time.Second, 4 * time.Second}},
+		{&Options{MaxRetry: 4, ImmediateAttempts: 1, Strategy: BackoffLinear}, []time.Duration{0, time.Second, 2 * time.Second, 3 * time.Second}},
+		// The immediate retries count towards MaxRetry.
+		{&Options{MaxRetry: 2, ImmediateAttempts: 3}, []time.Duration{0, 0}},
+	} {
+		clock := newFakeClock()
+		tc.options.Clock = clock
+		calls := 0
+		err := IfNecessary(context.Background(), func() error {
+			calls++
+			return syscall.ECONNRESET
+		}, tc.options)
+		require.True(t, IsExhausted(err))
+		require.Equal(t, tc.options.MaxRetry+1, calls)
+		require.Equal(t, tc.expected, clock.Slept(), "%+v", tc.options)
+		require.Equal(t, tc.expected, tc.options.DelaySchedule(), "%+v", tc.options)
+	}
+}
+
+func TestBackoffOverflow(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, strategy := range []BackoffStrategy{BackoffExponential, BackoffFullJitter, BackoffDecorrelated, BackoffLinear, BackoffConstant, BackoffFibonacci} {
+		for _, factor := range []float64{0, 0.9, 1} {
+			options := &Options{MaxRetry: 64, Strategy: strategy, BaseDelay: time.Hour, RandomizationFactor: factor}
+			prev, prevBackoff := time.Duration(0), time.Duration(0)
+			for attempt := 0; attempt < options.MaxRetry; attempt++ {
+				delay := nextDelay(attempt, prev, options, rng)
+				require.GreaterOrEqual(t, delay, time.Duration(0), "strategy %d, factor %v, attempt %d", strategy, factor, attempt)
+				backoff := options.backoff(attempt)
+				require.GreaterOrEqual(t, backoff, prevBackoff, "strategy %d, factor %v, attempt %d", strategy, factor, attempt)
+				prev, prevBackoff = delay, backoff
+			}
+			for _, delay := range options.DelaySchedule() {
+				require.Greater(t, delay, time.Duration(0), "strategy %d, factor %v", strategy, factor)
+			}
+		}
+	}
+
+	// Saturated delays are randomized without overflowing either.
+	for _, factor := range []float64{0.6, 0.9, 1} {
+		options := &Options{MaxRetry: 70, RandomizationFactor: factor}
+		for attempt := 0; attempt < options.MaxRetry; attempt++ {
+			require.Greater(t, nextDelay(attempt, 0, options, rng), time.Duration(0), "factor %v, attempt %d", factor, attempt)
+		}
+		for _, delay := range options.DelaySchedule() {
+			require.Greater(t, delay, time.Duration(0), "factor %v", factor)
+		}
+	}
+
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 64, Clock: clock})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Len(t, clock.Slept(), 64)
+	for _, delay := range clock.Slept() {
+		require.Greater(t, delay, time.Duration(0))
+	}
+
+	options := &Options{MaxRetry: 64, MaxDelay: time.Minute}
+	require.Equal(t, time.Minute, options.backoff(63))
+	options = &Options{Factor: 10}
+	require.Equal(t, time.Duration(math.MaxInt64), options.backoff(1000))
+}
+
+func TestMaxJitter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for _, options := range []*Options{
+		{Jitter: true, MaxJitter: 500 * time.Millisecond, MaxDelay: 20 * time.Second},
+		{Strategy: BackoffFullJitter, MaxJitter: 500 * time.Millisecond, MaxDelay: 20 * time.Second},
+	} {
+		for attempt := 0; attempt < 10; attempt++ {
+			backoff := options.backoff(attempt)
+			delay := nextDelay(attempt, 0, options, rng)
+			require.Less(t, delay, backoff, "attempt %d", attempt)
+			require.LessOrEqual(t, backoff-delay, options.MaxJitter, "attempt %d", attempt)
+			require.LessOrEqual(t, delay, options.MaxDelay, "attempt %d", attempt)
+		}
+	}
+
+	// Delays shorter than MaxJitter are fully randomized.
+	options := &Options{Jitter: true, BaseDelay: 100 * time.Millisecond, MaxJitter: time.Second}
+	for i := 0; i < 10; i++ {
+		require.Less(t, nextDelay(0, 0, options, rng), 100*time.Millisecond)
+	}
+}
+
+func TestRandomizationFactor(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	options := &Options{BaseDelay: time.Second, RandomizationFactor: 0.5, MaxDelay: 20 * time.Second}
+	for attempt := 0; attempt < 10; attempt++ {
+		interval := options.backoff(attempt)
+		for i := 0; i < 20; i++ {
+			delay := nextDelay(attempt, 0, options, rng)
+			require.GreaterOrEqual(t, delay, interval/2, "attempt %d", attempt)
+			require.Less(t, delay, interval*3/2, "attempt %d", attempt)
+			require.LessOrEqual(t, delay, options.MaxDelay, "attempt %d", attempt)
+		}
+	}
+	require.Equal(t, []time.Duration{1500 * time.Millisecond, 3 * time.Second, 6 * time.Second, 12 * time.Second, 20 * time.Second},
+		(&Options{MaxRetry: 5, BaseDelay: time.Second, RandomizationFactor: 0.5, MaxDelay: 20 * time.Second}).DelaySchedule())
+
+	// Without a factor, the delays are not randomized.
+	options.RandomizationFactor = 0
+	for attempt := 0; attempt < 10; attempt++ {
+		require.Equal(t, options.backoff(attempt), nextDelay(attempt, 0, options, nil))
+	}
+}
@@ -0,0 +1,124 @@
+package retry
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned, without running the operation, by a retry loop
+// whose CircuitBreaker does not allow an attempt.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker stops all the retry loops sharing it from making attempts
+// against a dependency which has been failing persistently.
+// Implementations must be safe for concurrent use.
+type CircuitBreaker interface {
+	// Allow is called before every attempt, including the first one, and
+	// returns false if the attempt must not be made, in which case the
+	// retry loop returns ErrCircuitOpen.
+	Allow() bool
+	// RecordSuccess is called after every allowed attempt which succeeded.
+	RecordSuccess()
+	// RecordFailure is called after every allowed attempt which failed.
+	RecordFailure()
+}
+
+// breakerState is the state of a RollingBreaker.
+type breakerState int
+
+const (
+	breakerClosed   breakerState = iota // Attempts are allowed.
+	breakerOpen                         // Attempts are refused until the cooldown passes.
+	breakerHalfOpen                     // A single probe attempt is in flight.
+)
+
+// RollingBreaker is a CircuitBreaker which opens once a number of attempts
+// have failed within a rolling window of time.  After a cooldown, it lets a
+// single probe attempt through: the breaker closes again if it succeeds,
+// and stays open for another cooldown if it fails.
+type RollingBreaker struct {
+	threshold int           // Failures within window opening the breaker
+	window    time.Duration // Duration over which failures are counted
+	cooldown  time.Duration // Duration the breaker stays open
+
+	mu       sync.Mutex
+	state    breakerState
+	failures []time.Time // Times of the failures within window, oldest first
+	openedAt time.Time
+	clock    Clock
+}
+
+// NewRollingBreaker returns a closed RollingBreaker which opens once
+// threshold attempts have failed within window, and stays open for cooldown
+// before letting a probe attempt through.
+func NewRollingBreaker(threshold int, window, cooldown time.Duration) *RollingBreaker {
+	return newRollingBreaker(threshold, window, cooldown, realClock{})
+}
+
+func newRollingBreaker(threshold int, window, cooldown time.Duration, clock Clock) *RollingBreaker {
+	return &RollingBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		clock:     clock,
+	}
+}
+
+// Allow returns true if the breaker is closed, or if the cooldown has
+// passed and no other probe attempt is in flight.
+func (b *RollingBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.clock.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		return false
+	default:
+		return true
+	}
+}
+
+// RecordSuccess closes the breaker after a successful probe attempt.
+func (b *RollingBreaker) RecordSuccess() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerHalfOpen {
+		b.state = breakerClosed
+		b.failures = nil
+	}
+}
+
+// RecordFailure counts a failed attempt, and opens the breaker if the
+// threshold is reached or a probe attempt failed.
+func (b *RollingBreaker) RecordFailure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.clock.Now()
+	switch b.state {
+	case breakerHalfOpen:
+		b.open(now)
+	case breakerClosed:
+		b.failures = append(b.failures, now)
+		expired := 0
+		for expired < len(b.failures) && now.Sub(b.failures[expired]) >= b.window {
+			expired++
+		}
+		b.failures = b.failures[expired:]
+		if len(b.failures) >= b.threshold {
+			b.open(now)
+		}
+	}
+}
+
+// open opens the breaker at now.  b.mu must be held.
+func (b *RollingBreaker) open(now time.Time) {
+	b.state = breakerOpen
+	b.openedAt = now
+	b.failures = nil
+}
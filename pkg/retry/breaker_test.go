@@ -0,0 +1,83 @@
+package retry
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRollingBreaker(t *testing.T) {
+	clock := newFakeClock()
+	breaker := newRollingBreaker(3, time.Minute, 10*time.Second, clock)
+
+	// Failures older than the window are forgotten.
+	breaker.RecordFailure()
+	breaker.RecordFailure()
+	<-clock.After(time.Minute)
+	breaker.RecordFailure()
+	breaker.RecordFailure()
+	require.True(t, breaker.Allow())
+
+	// The threshold is reached within the window: open.
+	breaker.RecordFailure()
+	require.False(t, breaker.Allow())
+	<-clock.After(5 * time.Second)
+	require.False(t, breaker.Allow())
+
+	// After the cooldown, a single probe is allowed: half-open.
+	<-clock.After(5 * time.Second)
+	require.True(t, breaker.Allow())
+	require.False(t, breaker.Allow())
+
+	// The probe fails: open for another cooldown.
+	breaker.RecordFailure()
+	require.False(t, breaker.Allow())
+	<-clock.After(10 * time.Second)
+	require.True(t, breaker.Allow())
+
+	// The probe succeeds: closed, with the failures counted afresh.
+	breaker.RecordSuccess()
+	require.True(t, breaker.Allow())
+	breaker.RecordFailure()
+	breaker.RecordFailure()
+	require.True(t, breaker.Allow())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	clock := newFakeClock()
+	options := &Options{
+		MaxRetry:       5,
+		Delay:          time.Second,
+		CircuitBreaker: newRollingBreaker(3, time.Minute, time.Minute, clock),
+		Clock:          clock,
+	}
+	calls := 0
+	operation := func() error {
+		calls++
+		return syscall.ECONNRESET
+	}
+
+	// The breaker opens after the third attempt, stopping the retries.
+	err := IfNecessary(context.Background(), operation, options)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.False(t, IsExhausted(err))
+	require.Equal(t, 3, calls)
+
+	// Further operations fail immediately, including their first attempt.
+	err = IfNecessary(context.Background(), operation, options)
+	require.Equal(t, ErrCircuitOpen, err)
+	require.Equal(t, 3, calls)
+
+	// Once the cooldown has passed, a successful probe closes the breaker.
+	<-clock.After(time.Minute)
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return nil
+	}, options)
+	require.NoError(t, err)
+	require.Equal(t, 4, calls)
+	require.True(t, options.CircuitBreaker.Allow())
+}
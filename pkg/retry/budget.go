@@ -0,0 +1,87 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// Budget limits the retries across all the retry loops sharing it, so that
+// a widespread outage does not multiply the load on the failing dependency.
+// Implementations must be safe for concurrent use.
+type Budget interface {
+	// Deposit is called once per retry loop, before the first attempt.
+	Deposit()
+	// Allow is called before every retry, once no other option stops it,
+	// and returns false if the retry must not happen, in which case the
+	// retry loop returns the error of the last attempt.
+	Allow() bool
+}
+
+// TokenBucket is a Budget where every retry consumes a token.  Tokens are
+// refilled continuously at a fixed rate, and every retry loop deposits a
+// fraction of a token, so that retries are allowed in proportion to the
+// number of operations.  The number of stored tokens is capped, bounding
+// the burst of retries allowed once the dependency starts failing.
+type TokenBucket struct {
+	rate  float64 // Tokens refilled per second
+	ratio float64 // Tokens deposited per retry loop
+	burst float64 // Maximum number of stored tokens
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+	clock  Clock
+}
+
+// NewTokenBucket returns a full TokenBucket holding up to burst tokens,
+// refilled with rate tokens per second and with ratio tokens for every
+// retry loop.  For example, a ratio of 0.1 allows one retry for every ten
+// operations.
+func NewTokenBucket(rate, ratio float64, burst int) *TokenBucket {
+	return newTokenBucket(rate, ratio, burst, realClock{})
+}
+
+func newTokenBucket(rate, ratio float64, burst int, clock Clock) *TokenBucket {
+	return &TokenBucket{
+		rate:   rate,
+		ratio:  ratio,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   clock.Now(),
+		clock:  clock,
+	}
+}
+
+// Deposit adds the per-operation ratio of tokens to the bucket.
+func (b *TokenBucket) Deposit() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.tokens = minFloat(b.tokens+b.ratio, b.burst)
+}
+
+// Allow consumes a token if one is available.
+func (b *TokenBucket) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refill adds the tokens accumulated since the last call.  b.mu must be held.
+func (b *TokenBucket) refill() {
+	now := b.clock.Now()
+	b.tokens = minFloat(b.tokens+now.Sub(b.last).Seconds()*b.rate, b.burst)
+	b.last = now
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
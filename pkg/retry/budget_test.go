@@ -0,0 +1,72 @@
+package retry
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenBucket(t *testing.T) {
+	clock := newFakeClock()
+	bucket := newTokenBucket(1, 0.5, 2, clock)
+	require.True(t, bucket.Allow())
+	require.True(t, bucket.Allow())
+	require.False(t, bucket.Allow())
+
+	// Two operations earn one retry.
+	bucket.Deposit()
+	require.False(t, bucket.Allow())
+	bucket.Deposit()
+	require.True(t, bucket.Allow())
+	require.False(t, bucket.Allow())
+
+	// Tokens are refilled over time, up to the burst.
+	<-clock.After(10 * time.Second)
+	require.True(t, bucket.Allow())
+	require.True(t, bucket.Allow())
+	require.False(t, bucket.Allow())
+}
+
+func TestBudget(t *testing.T) {
+	clock := newFakeClock()
+	// No refill over time, one retry for every two operations.
+	options := &Options{MaxRetry: 5, Budget: newTokenBucket(0, 0.5, 3, clock), Clock: clock}
+	total := 0
+	for i := 0; i < 4; i++ {
+		attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, options)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		total += attempts
+	}
+	// 4 first attempts, 3 retries using the initial tokens, and 1 more
+	// using tokens deposited by the 2nd and 3rd operations.
+	require.Equal(t, 4+3+1, total)
+}
+
+// countingBudget is a Budget recording the calls to Allow.
+type countingBudget struct {
+	allowed int
+}
+
+func (b *countingBudget) Deposit() {}
+
+func (b *countingBudget) Allow() bool {
+	b.allowed++
+	return true
+}
+
+func TestBudgetVetoedRetry(t *testing.T) {
+	// No token is used for a retry which PreRetry stops.
+	budget := &countingBudget{}
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Budget: budget, Clock: newFakeClock(), PreRetry: func(ctx context.Context, attempt int, err error) bool {
+		return attempt < 2
+	}})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 1, budget.allowed)
+}
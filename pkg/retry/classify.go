@@ -0,0 +1,165 @@
+package retry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"sync"
+	"syscall"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/hashicorp/go-multierror"
+)
+
+// IsRetryable returns true if err is considered transient, so that retrying
+// the failed operation may succeed.
+//
+// The known error types are looked up anywhere in the chain of wrapped errors
+// using errors.As, so that errors wrapped with fmt.Errorf("%w") or by other
+// libraries are classified like the errors they wrap.
+func IsRetryable(err error) bool {
+	return classify(err, nil, false)
+}
+
+var (
+	classifiersMu sync.RWMutex
+	classifiers   []func(err error) (retryable, handled bool)
+)
+
+// RegisterClassifier adds a function classifying errors for IsRetryable, and
+// the retry loops relying on it, e.g. to recognize the error types of another
+// library.  The registered functions are consulted in order, before the
+// built-in classification, and the first one reporting that it handled err
+// decides whether it is retryable.  Errors matching context.Canceled or
+// context.DeadlineExceeded are never retried, whatever the classifiers.
+// RegisterClassifier is safe for concurrent use, but is meant to be called
+// from init functions.
+func RegisterClassifier(fn func(err error) (retryable, handled bool)) {
+	classifiersMu.Lock()
+	defer classifiersMu.Unlock()
+	classifiers = append(classifiers, fn)
+}
+
+// registeredClassification returns the classification of err by the first
+// registered classifier handling it, if any.
+func registeredClassification(err error) (retryable, handled bool) {
+	classifiersMu.RLock()
+	defer classifiersMu.RUnlock()
+	for _, fn := range classifiers {
+		if retryable, handled := fn(err); handled {
+			return retryable, true
+		}
+	}
+	return false, false
+}
+
+// classify implements IsRetryable.  If retryableCodes is not nil, it
+// replaces the built-in list of retryable docker distribution error codes.
+// If anyRetryable is set, a group of errors is retryable if any of its
+// members is, instead of all of them.
+func classify(err error, retryableCodes map[errcode.ErrorCode]bool, anyRetryable bool) bool {
+	// The context errors may be wrapped by an operation which checked its
+	// context; retrying would fail in the same way.
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if retryable, handled := registeredClassification(err); handled {
+		return retryable
+	}
+
+	var (
+		multiErr   *multierror.Error
+		errs       errcode.Errors
+		errcodeErr errcode.Error
+		statusErr  StatusCoder
+		protoErr   textproto.ProtocolError
+		urlErr     *url.Error
+		opErr      *net.OpError
+		dnsErr     *net.DNSError
+		errno      syscall.Errno
+		netErr     net.Error
+		panicErr   *PanicError
+
+		unknownAuthorityErr   x509.UnknownAuthorityError
+		certificateInvalidErr x509.CertificateInvalidError
+		hostnameErr           x509.HostnameError
+		recordHeaderErr       tls.RecordHeaderError
+	)
+	// Groups of errors are tested first, they must be processed in turn.
+	// A *multierror.Error unwraps to its members, so it goes first.  A group
+	// is retryable if all its members are, or any with AnyRetryable; an
+	// empty group reports no failure that could be transient, so it is not.
+	switch {
+	case errors.As(err, &panicErr):
+		// Unwrapping to the value passed to panic must not make it retryable.
+		return false
+	case errors.As(err, &multiErr):
+		return classifyGroup(multiErr.Errors, retryableCodes, anyRetryable)
+	case errors.As(err, &errs):
+		return classifyGroup(errs, retryableCodes, anyRetryable)
+	// Certificate and TLS handshake failures are configuration problems, not
+	// transient ones; test them before the *url.Error they are usually
+	// wrapped in.
+	case errors.As(err, &unknownAuthorityErr), errors.As(err, &certificateInvalidErr), errors.As(err, &hostnameErr), errors.As(err, &recordHeaderErr):
+		return false
+	case errors.Is(err, io.ErrUnexpectedEOF): // A connection was closed in the middle of a response
+		return true
+	case errors.As(err, &errcodeErr):
+		if retryableCodes != nil {
+			return retryableCodes[errcodeErr.Code]
+		}
+		// Only server-side and throttling failures may go away; anything
+		// else (authentication, unknown names, invalid input, etc.) will not.
+		switch errcodeErr.Code {
+		case errcode.ErrorCodeUnknown, errcode.ErrorCodeUnavailable, errcode.ErrorCodeTooManyRequests:
+			return true
+		}
+		return false
+	case errors.As(err, &statusErr):
+		return isStatusCodeRetryable(statusErr.StatusCode())
+	case errors.As(err, &protoErr), isMalformedResponse(err):
+		// A garbled response, e.g. from a flaky proxy.
+		return true
+	case errors.As(err, &urlErr): // This includes errors returned by the net/http client.
+		if urlErr.Err == io.EOF { // Happens when a server accepts a HTTP connection and sends EOF
+			return true
+		}
+		if code, ok := proxyConnectStatus(urlErr.Err); ok {
+			return isStatusCodeRetryable(code)
+		}
+		return classify(urlErr.Err, retryableCodes, anyRetryable)
+	case errors.As(err, &dnsErr):
+		// A name which does not exist will not appear by retrying, but a
+		// failing or slow resolver may recover.
+		return !dnsErr.IsNotFound && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+	case errors.As(err, &opErr):
+		return classify(opErr.Err, retryableCodes, anyRetryable)
+	case errors.As(err, &errno):
+		return isRetryableSyscall(errno)
+	case errors.As(err, &netErr): // Test this last, because various error types implement net.Error
+		// This catches network errors of unknown types.  Temporary() is
+		// deprecated, and true for many errors which are not transient.
+		return netErr.Timeout()
+	}
+
+	return false
+}
+
+// classifyGroup returns true if all the members of a group of errors are
+// retryable, or any of them if anyRetryable is set.  An empty group is not.
+func classifyGroup(members []error, retryableCodes map[errcode.ErrorCode]bool, anyRetryable bool) bool {
+	if len(members) == 0 {
+		return false
+	}
+	for _, member := range members {
+		if classify(member, retryableCodes, anyRetryable) == anyRetryable {
+			return anyRetryable
+		}
+	}
+	return !anyRetryable
+}
@@ -0,0 +1,322 @@
+package retry
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	errcodev2 "github.com/docker/distribution/registry/api/v2"
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryableErrcode(t *testing.T) {
+	for _, tc := range []struct {
+		code      errcode.ErrorCode
+		retryable bool
+	}{
+		{errcode.ErrorCodeUnknown, true},
+		{errcode.ErrorCodeUnavailable, true},
+		{errcode.ErrorCodeTooManyRequests, true},
+		{errcode.ErrorCodeUnsupported, false},
+		{errcode.ErrorCodeUnauthorized, false},
+		{errcode.ErrorCodeDenied, false},
+		{errcodev2.ErrorCodeDigestInvalid, false},
+		{errcodev2.ErrorCodeSizeInvalid, false},
+		{errcodev2.ErrorCodeNameInvalid, false},
+		{errcodev2.ErrorCodeTagInvalid, false},
+		{errcodev2.ErrorCodeNameUnknown, false},
+		{errcodev2.ErrorCodeManifestUnknown, false},
+		{errcodev2.ErrorCodeManifestInvalid, false},
+		{errcodev2.ErrorCodeManifestUnverified, false},
+		{errcodev2.ErrorCodeManifestBlobUnknown, false},
+		{errcodev2.ErrorCodeBlobUnknown, false},
+		{errcodev2.ErrorCodeBlobUploadUnknown, false},
+		{errcodev2.ErrorCodeBlobUploadInvalid, false},
+	} {
+		err := tc.code.WithMessage("test")
+		require.Equal(t, tc.retryable, IsRetryable(err), "%s", tc.code)
+		require.Equal(t, tc.retryable, IsRetryable(errcode.Errors{err}), "%s", tc.code)
+	}
+}
+
+func TestRetryableCodes(t *testing.T) {
+	options := &Options{
+		MaxRetry: 1,
+		RetryableCodes: map[errcode.ErrorCode]bool{
+			errcode.ErrorCodeUnauthorized: true,  // e.g. a registry which reports expired tokens this way
+			errcode.ErrorCodeUnavailable:  false, // e.g. a registry which reports permanent failures this way
+		},
+		Clock: newFakeClock(),
+	}
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{errcode.ErrorCodeUnauthorized.WithMessage("token expired"), true},
+		{errcode.Errors{errcode.ErrorCodeUnauthorized.WithMessage("token expired")}, true},
+		{fmt.Errorf("pulling: %w", errcode.ErrorCodeUnauthorized.WithMessage("token expired")), true},
+		{errcode.ErrorCodeUnavailable.WithMessage("test"), false},
+		{errcode.ErrorCodeTooManyRequests.WithMessage("test"), false},
+		{errcode.Errors{errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied}, false},
+		// Other errors are classified as usual.
+		{syscall.ECONNRESET, true},
+	} {
+		require.Equal(t, tc.retryable, options.isRetryable(tc.err), "%v", tc.err)
+	}
+
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return errcode.ErrorCodeUnauthorized.WithMessage("token expired")
+		}
+		return nil
+	}, options)
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+	// The built-in classification is unchanged.
+	require.False(t, IsRetryable(errcode.ErrorCodeUnauthorized.WithMessage("test")))
+}
+
+func TestIsRetryableWrapped(t *testing.T) {
+	var err error = syscall.ECONNRESET
+	err = &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", err)}
+	err = fmt.Errorf("reading blob: %w", err)
+	err = &url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: err}
+	err = fmt.Errorf("pulling image: %w", err)
+	require.True(t, IsRetryable(err))
+
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{fmt.Errorf("a: %w", fmt.Errorf("b: %w", fmt.Errorf("c: %w", syscall.ECONNRESET))), true},
+		{fmt.Errorf("a: %w", fmt.Errorf("b: %w", fmt.Errorf("c: %w", syscall.EPERM))), false},
+		{fmt.Errorf("registry: %w", errcode.ErrorCodeUnavailable.WithMessage("test")), true},
+		{fmt.Errorf("registry: %w", errcode.ErrorCodeDenied.WithMessage("test")), false},
+		{fmt.Errorf("group: %w", &multierror.Error{Errors: []error{syscall.ECONNRESET, syscall.ETIMEDOUT}}), true},
+		{fmt.Errorf("group: %w", &multierror.Error{Errors: []error{syscall.ECONNRESET, syscall.EPERM}}), false},
+		{&multierror.Error{Errors: []error{errcode.Errors{syscall.ECONNRESET}, syscall.EPERM}}, false},
+		{errors.New("unknown"), false},
+	} {
+		require.Equal(t, tc.retryable, IsRetryable(tc.err), "%v", tc.err)
+	}
+}
+
+func TestIsRetryableEmptyGroup(t *testing.T) {
+	for _, err := range []error{
+		errcode.Errors{},
+		errcode.Errors(nil),
+		fmt.Errorf("registry: %w", errcode.Errors{}),
+		&multierror.Error{},
+		&multierror.Error{Errors: []error{}},
+		fmt.Errorf("group: %w", &multierror.Error{}),
+		&multierror.Error{Errors: []error{errcode.Errors{}}},
+	} {
+		require.False(t, IsRetryable(err), "%#v", err)
+	}
+
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		return errcode.Errors{}
+	}, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.Equal(t, errcode.Errors{}, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestAnyRetryable(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		all, any bool
+	}{
+		{&multierror.Error{Errors: []error{syscall.ECONNRESET, syscall.EPERM}}, false, true},
+		{&multierror.Error{Errors: []error{syscall.EPERM, syscall.ECONNRESET}}, false, true},
+		{&multierror.Error{Errors: []error{syscall.ECONNRESET, syscall.ETIMEDOUT}}, true, true},
+		{&multierror.Error{Errors: []error{syscall.EPERM, syscall.EACCES}}, false, false},
+		{errcode.Errors{errcode.ErrorCodeDenied.WithMessage("test"), errcode.ErrorCodeUnavailable.WithMessage("test")}, false, true},
+		{&multierror.Error{Errors: []error{errcode.Errors{syscall.EPERM, syscall.ECONNRESET}, syscall.EPERM}}, false, true},
+		{&multierror.Error{}, false, false},
+		{errcode.Errors{}, false, false},
+	} {
+		require.Equal(t, tc.all, (&Options{}).isRetryable(tc.err), "%v", tc.err)
+		require.Equal(t, tc.any, (&Options{AnyRetryable: true}).isRetryable(tc.err), "%v", tc.err)
+	}
+
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return &multierror.Error{Errors: []error{syscall.EPERM, syscall.ECONNRESET}}
+		}
+		return nil
+	}, &Options{MaxRetry: 3, AnyRetryable: true, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+}
+
+func TestIsRetryableInterruptedConnection(t *testing.T) {
+	for _, inner := range []error{
+		io.EOF,
+		io.ErrUnexpectedEOF,
+		fmt.Errorf("reading body: %w", io.ErrUnexpectedEOF),
+		syscall.ECONNRESET,
+		syscall.EPIPE,
+		&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)},
+		&net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)},
+	} {
+		err := &url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: inner}
+		require.True(t, IsRetryable(err), "%v", err)
+	}
+	require.True(t, IsRetryable(io.ErrUnexpectedEOF))
+}
+
+func TestIsRetryableTLS(t *testing.T) {
+	for _, inner := range []error{
+		x509.UnknownAuthorityError{},
+		x509.CertificateInvalidError{Reason: x509.Expired},
+		x509.HostnameError{Certificate: &x509.Certificate{}, Host: "registry.example"},
+		&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}},
+		tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"},
+	} {
+		err := &url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: inner}
+		require.False(t, IsRetryable(err), "%v", err)
+		// Regardless of how deeply they are wrapped.
+		err = &url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: &net.OpError{Op: "remote error", Net: "tcp", Err: inner}}
+		require.False(t, IsRetryable(fmt.Errorf("pinging registry: %w", err)), "%v", err)
+	}
+}
+
+func TestIsRetryableContext(t *testing.T) {
+	for _, err := range []error{
+		context.Canceled,
+		context.DeadlineExceeded,
+		fmt.Errorf("pulling layer: %w", context.Canceled),
+		fmt.Errorf("pulling layer: %w", fmt.Errorf("reading: %w", context.DeadlineExceeded)),
+		&url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: context.DeadlineExceeded},
+	} {
+		require.False(t, IsRetryable(err), "%v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := IfNecessaryCtx(ctx, func(ctx context.Context) error {
+		calls++
+		cancel()
+		return fmt.Errorf("operation: %w", ctx.Err())
+	}, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 1, calls)
+}
+
+func TestIsRetryableDNS(t *testing.T) {
+	for _, tc := range []struct {
+		err       *net.DNSError
+		retryable bool
+	}{
+		{&net.DNSError{Err: "server misbehaving", Name: "registry.example", IsTemporary: true}, true},
+		{&net.DNSError{Err: "i/o timeout", Name: "registry.example", IsTimeout: true}, true},
+		{&net.DNSError{Err: "no such host", Name: "registry.example", IsNotFound: true}, false},
+		{&net.DNSError{Err: "no such host", Name: "registry.example", IsNotFound: true, IsTemporary: true}, false},
+		{&net.DNSError{Err: "unknown", Name: "registry.example"}, false},
+	} {
+		require.Equal(t, tc.retryable, IsRetryable(tc.err), "%v", tc.err)
+		// As returned by the net/http client.
+		var err error = &net.OpError{Op: "dial", Net: "tcp", Err: tc.err}
+		err = &url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: err}
+		require.Equal(t, tc.retryable, IsRetryable(err), "%v", err)
+	}
+}
+
+// netError is a network error of a type IsRetryable does not know.
+type netError struct {
+	timeout, temporary bool
+}
+
+func (e netError) Error() string   { return "network error" }
+func (e netError) Timeout() bool   { return e.timeout }
+func (e netError) Temporary() bool { return e.temporary }
+
+func TestIsRetryableNetError(t *testing.T) {
+	for _, tc := range []struct {
+		err       net.Error
+		retryable bool
+	}{
+		{netError{timeout: true}, true},
+		{netError{timeout: true, temporary: true}, true},
+		{netError{temporary: true}, false},
+		{netError{}, false},
+	} {
+		require.Equal(t, tc.retryable, IsRetryable(tc.err), "%+v", tc.err)
+		require.Equal(t, tc.retryable, IsRetryable(fmt.Errorf("proxying: %w", tc.err)), "%+v", tc.err)
+	}
+}
+
+// quotaError is an error type of another library.
+type quotaError struct {
+	exceeded bool
+}
+
+func (e quotaError) Error() string {
+	return "quota"
+}
+
+func TestRegisterClassifier(t *testing.T) {
+	classifiersMu.Lock()
+	saved := classifiers
+	classifiersMu.Unlock()
+	defer func() {
+		classifiersMu.Lock()
+		classifiers = saved
+		classifiersMu.Unlock()
+	}()
+
+	require.False(t, IsRetryable(quotaError{exceeded: true}))
+	RegisterClassifier(func(err error) (bool, bool) {
+		var quotaErr quotaError
+		if !errors.As(err, &quotaErr) {
+			return false, false
+		}
+		return quotaErr.exceeded, true
+	})
+	// Only the first classifier handling an error decides.
+	RegisterClassifier(func(err error) (bool, bool) {
+		return false, true
+	})
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{quotaError{exceeded: true}, true},
+		{fmt.Errorf("uploading: %w", quotaError{exceeded: true}), true},
+		{&multierror.Error{Errors: []error{quotaError{exceeded: true}, quotaError{exceeded: true}}}, true},
+		{quotaError{}, false},
+		// The classifiers take precedence over the built-in classification.
+		{syscall.ECONNRESET, false},
+		// But not over canceled contexts.
+		{fmt.Errorf("%w: %w", context.Canceled, quotaError{exceeded: true}), false},
+	} {
+		require.Equal(t, tc.retryable, IsRetryable(tc.err), "%v", tc.err)
+	}
+
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return quotaError{exceeded: true}
+		}
+		return nil
+	}, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+}
@@ -0,0 +1,39 @@
+package retry
+
+import "time"
+
+// Clock abstracts the passage of time, so that Plan and tests can simulate
+// long backoff delays without actually waiting.  Implementations must be safe
+// for concurrent use.
+type Clock interface {
+	Now() time.Time
+	// Since returns the time elapsed since t, a value returned by Now.  It
+	// must not be affected by changes of the wall clock, e.g. by NTP.
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+}
+
+// realClock is the clock of the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Since relies on the monotonic clock reading of the values returned by
+// time.Now.
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// getClock returns the clock the retry loop uses.
+func (o *Options) getClock() Clock {
+	if o.Clock != nil {
+		return o.Clock
+	}
+	return realClock{}
+}
@@ -0,0 +1,45 @@
+package retry
+
+import (
+	"time"
+
+	"github.com/containers/common/pkg/retry/internal/fakeclock"
+)
+
+// fakeClock is the clock used by tests.
+type fakeClock = fakeclock.Clock
+
+func newFakeClock() *fakeClock {
+	return fakeclock.New(time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC))
+}
+
+// jumpingClock is a fakeClock whose wall time jumps back by an hour after
+// its third After call, to simulate a correction by NTP, while its Since
+// measures the elapsed time like a monotonic clock.
+type jumpingClock struct {
+	*fakeClock
+	mono   time.Duration               // The monotonic time elapsed so far.
+	monoAt map[time.Time]time.Duration // The value of mono when Now returned each value.
+}
+
+func newJumpingClock() *jumpingClock {
+	return &jumpingClock{fakeClock: newFakeClock(), monoAt: map[time.Time]time.Duration{}}
+}
+
+func (c *jumpingClock) Now() time.Time {
+	now := c.fakeClock.Now()
+	if len(c.Slept()) >= 3 {
+		now = now.Add(-time.Hour)
+	}
+	c.monoAt[now] = c.mono
+	return now
+}
+
+func (c *jumpingClock) Since(t time.Time) time.Duration {
+	return c.mono - c.monoAt[t]
+}
+
+func (c *jumpingClock) After(d time.Duration) <-chan time.Time {
+	c.mono += d
+	return c.fakeClock.After(d)
+}
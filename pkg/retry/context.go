@@ -0,0 +1,26 @@
+package retry
+
+import "context"
+
+// optionsKey is the context key of the Options stored by ContextWithOptions.
+type optionsKey struct{}
+
+// ContextWithOptions returns a context derived from ctx carrying options, so
+// that IfNecessaryFromContext can use them without having them passed through
+// every layer of a call chain, e.g. to apply a per-tenant policy.  The options
+// must not be modified afterwards.  Functions with an options parameter, like
+// IfNecessary, ignore the options carried by ctx: explicit options always win.
+func ContextWithOptions(ctx context.Context, options *Options) context.Context {
+	return context.WithValue(ctx, optionsKey{}, options)
+}
+
+// IfNecessaryFromContext retries the operation like IfNecessary, with the
+// Options carried by ctx, see ContextWithOptions, or DefaultOptions if there
+// are none.
+func IfNecessaryFromContext(ctx context.Context, operation func() error) error {
+	options, ok := ctx.Value(optionsKey{}).(*Options)
+	if !ok {
+		options = DefaultOptions()
+	}
+	return IfNecessary(ctx, operation, options)
+}
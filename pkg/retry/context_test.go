@@ -0,0 +1,42 @@
+package retry
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIfNecessaryFromContext(t *testing.T) {
+	clock := newFakeClock()
+	ctx := ContextWithOptions(context.Background(), &Options{MaxRetry: 2, Delay: time.Second, Clock: clock})
+	calls := 0
+	err := IfNecessaryFromContext(ctx, func() error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, 3, calls)
+	require.Equal(t, []time.Duration{time.Second, time.Second}, clock.Slept())
+
+	// Explicit options win over those of the context.
+	calls = 0
+	err = IfNecessary(ctx, func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, 2, calls)
+
+	// Without options in the context, DefaultOptions are used: they do
+	// retry, so the cancellation of ctx ends the loop.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = IfNecessaryFromContext(ctx, func() error {
+		return syscall.ECONNRESET
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+}
@@ -0,0 +1,119 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Endpoint is one of the endpoints the attempts of an operation are spread
+// over by AcrossEndpoints, e.g. a mirror of a registry.
+type Endpoint struct {
+	Address string
+	// Weight is the share of the attempts made against the endpoint,
+	// relative to the others.  0 means 1.
+	Weight int
+}
+
+// weight returns the Weight of the endpoint, or its default if not set.
+func (e Endpoint) weight() int {
+	if e.Weight <= 0 {
+		return 1
+	}
+	return e.Weight
+}
+
+// ErrNoEndpoints is returned by AcrossEndpoints and WithRotation, without
+// running the operation, if there are no endpoints to make attempts against.
+var ErrNoEndpoints = errors.New("no endpoints to try")
+
+// Rotation picks the endpoints the attempts of operations are made against,
+// in a smooth weighted round-robin.  It remembers the endpoint of the last
+// successful attempt, so that the next operation starts with it.  A Rotation
+// is safe for concurrent use.
+type Rotation struct {
+	mu        sync.Mutex
+	endpoints []Endpoint
+	current   []int // The running weights of the round-robin.
+	preferred int   // The index of the endpoint which last succeeded, or -1.
+}
+
+// NewRotation returns a Rotation over a copy of endpoints.
+func NewRotation(endpoints []Endpoint) *Rotation {
+	return &Rotation{
+		endpoints: append([]Endpoint(nil), endpoints...),
+		current:   make([]int, len(endpoints)),
+		preferred: -1,
+	}
+}
+
+// next returns the index of the endpoint of the attempt following one made
+// against the endpoint at index prev, or -1 for the first attempt.  Unless
+// there is a single endpoint, a retry never uses the same endpoint as the
+// attempt it follows.
+func (r *Rotation) next(prev int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if prev < 0 && r.preferred >= 0 {
+		return r.preferred
+	}
+	for {
+		total, best := 0, 0
+		for i := range r.endpoints {
+			r.current[i] += r.endpoints[i].weight()
+			total += r.endpoints[i].weight()
+			if r.current[i] > r.current[best] {
+				best = i
+			}
+		}
+		r.current[best] -= total
+		if best != prev || len(r.endpoints) == 1 {
+			return best
+		}
+	}
+}
+
+// record remembers whether the attempt made against the endpoint at index i
+// succeeded.
+func (r *Rotation) record(i int, failed bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case !failed:
+		r.preferred = i
+	case r.preferred == i:
+		r.preferred = -1
+	}
+}
+
+// AcrossEndpoints retries the operation with the retry Options like
+// IfNecessaryWithResult, making every attempt against the next of the
+// endpoints in a weighted round-robin.  The backoff between the attempts is
+// the usual one.
+func AcrossEndpoints[T any](ctx context.Context, endpoints []Endpoint, operation func(endpoint Endpoint) (T, error), options *Options) (T, error) {
+	return WithRotation(ctx, NewRotation(endpoints), operation, options)
+}
+
+// WithRotation is like AcrossEndpoints, with endpoints picked by rotation,
+// so that an operation starts with the endpoint on which the previous one
+// succeeded.  The attempts must not run concurrently, so HedgeDelay is
+// ignored.
+func WithRotation[T any](ctx context.Context, rotation *Rotation, operation func(endpoint Endpoint) (T, error), options *Options) (T, error) {
+	if len(rotation.endpoints) == 0 {
+		var zero T
+		return zero, ErrNoEndpoints
+	}
+	rotationOptions := Options{}
+	if options != nil {
+		rotationOptions = *options
+	}
+	rotationOptions.HedgeDelay = 0
+	prev := -1
+	return IfNecessaryWithResult(ctx, func() (T, error) {
+		i := rotation.next(prev)
+		prev = i
+		result, err := operation(rotation.endpoints[i])
+		rotation.record(i, err != nil)
+		return result, err
+	}, &rotationOptions)
+}
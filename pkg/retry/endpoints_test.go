@@ -0,0 +1,68 @@
+package retry
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcrossEndpoints(t *testing.T) {
+	endpoints := []Endpoint{{Address: "mirror.example"}, {Address: "registry.example"}}
+	var tried []string
+	operation := func(endpoint Endpoint) (string, error) {
+		tried = append(tried, endpoint.Address)
+		if endpoint.Address == "mirror.example" {
+			return "", syscall.ECONNREFUSED
+		}
+		return "manifest", nil
+	}
+	clock := newFakeClock()
+	options := &Options{MaxRetry: 3, Clock: clock}
+	result, err := AcrossEndpoints(context.Background(), endpoints, operation, options)
+	require.NoError(t, err)
+	require.Equal(t, "manifest", result)
+	require.Equal(t, []string{"mirror.example", "registry.example"}, tried)
+	require.Equal(t, []time.Duration{time.Second}, clock.Slept())
+
+	// A Rotation starts with the endpoint which last succeeded.
+	rotation := NewRotation(endpoints)
+	for i := 0; i < 3; i++ {
+		tried = nil
+		_, err = WithRotation(context.Background(), rotation, operation, options)
+		require.NoError(t, err)
+		if i == 0 {
+			require.Equal(t, []string{"mirror.example", "registry.example"}, tried)
+		} else {
+			require.Equal(t, []string{"registry.example"}, tried)
+		}
+	}
+
+	_, err = AcrossEndpoints(context.Background(), nil, operation, options)
+	require.ErrorIs(t, err, ErrNoEndpoints)
+}
+
+func TestRotation(t *testing.T) {
+	rotation := NewRotation([]Endpoint{{Address: "a", Weight: 2}, {Address: "b"}})
+	var picked []string
+	for i := 0; i < 6; i++ {
+		picked = append(picked, rotation.endpoints[rotation.next(-1)].Address)
+	}
+	require.Equal(t, []string{"a", "b", "a", "a", "b", "a"}, picked)
+
+	// Retries never make consecutive attempts against the same endpoint.
+	prev := -1
+	picked = nil
+	for i := 0; i < 6; i++ {
+		prev = rotation.next(prev)
+		picked = append(picked, rotation.endpoints[prev].Address)
+	}
+	for i := 1; i < len(picked); i++ {
+		require.NotEqual(t, picked[i-1], picked[i], "%v", picked)
+	}
+
+	single := NewRotation([]Endpoint{{Address: "a"}})
+	require.Equal(t, 0, single.next(single.next(-1)))
+}
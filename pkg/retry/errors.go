@@ -0,0 +1,146 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+// Error is returned when the retries are exhausted while the operation is
+// still failing with a retryable error, after at least one retry.  Its message
+// is the one of LastErr, and it unwraps to LastErr, so errors.Is and errors.As
+// match the error of the operation.  errors.As also matches the
+// members of an errcode.Errors returned by the operation, e.g. to find the
+// errcode.Error of a registry response, which errcode.Errors itself does not
+// unwrap to.
+type Error struct {
+	Attempts  int           // The number of attempts of the operation that were made.
+	Elapsed   time.Duration // The time elapsed since the first attempt started.
+	SleepTime time.Duration // The part of Elapsed spent waiting between attempts.
+	ExecTime  time.Duration // The part of Elapsed spent running the attempts.
+	LastDelay time.Duration // The delay waited before the last attempt.
+	// The error of the last attempt, or a *multierror.Error of the errors
+	// of all the attempts if AggregateErrors is set.
+	LastErr error
+}
+
+func (e *Error) Error() string {
+	return e.LastErr.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.LastErr
+}
+
+// As is used by errors.As to also search the members of an errcode.Errors in
+// the chain of LastErr, in order.
+func (e *Error) As(target interface{}) bool {
+	var errs errcode.Errors
+	if !errors.As(e.LastErr, &errs) {
+		return false
+	}
+	for _, err := range errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExhausted returns true if err, or an error it wraps, is an *Error, i.e.
+// if the operation failed after all the retries were made, rather than with
+// an error that was not retried, without any retry permitted, or because the
+// context was done.
+func IsExhausted(err error) bool {
+	var retryErr *Error
+	return errors.As(err, &retryErr)
+}
+
+// permanentError marks an error that must not be retried.
+type permanentError struct {
+	err error
+}
+
+// Permanent wraps err so that the retry loop stops immediately when an
+// attempt of the operation returns it, regardless of how err would be
+// classified otherwise.  The loop then returns err itself.  Permanent
+// returns nil if err is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// retryableError marks an error that must be retried.
+type retryableError struct {
+	err error
+}
+
+// Retryable wraps err so that the retry loop retries the operation when an
+// attempt returns it, as long as retries are left, regardless of how err
+// would be classified otherwise.  Permanent takes precedence if both are
+// used, and so does Sent unless the Idempotent option is set.  If the retries
+// are exhausted, the loop returns err itself.  Retryable returns nil if err
+// is nil.
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &retryableError{err: err}
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// FatalError tags, in the *multierror.Error returned with AggregateErrors,
+// the error of the last attempt if the loop stopped because that error was
+// not retryable.  The errors of the preceding attempts, which were retried,
+// are not tagged, so callers can tell them apart with errors.As, which
+// also finds a FatalError in the *multierror.Error.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *FatalError) Unwrap() error {
+	return e.Err
+}
+
+// abortedError is returned when the context is canceled while waiting for a
+// retry.  It unwraps to the error of the last attempt, while errors.Is also
+// matches the cause of the cancellation, e.g. context.DeadlineExceeded.
+type abortedError struct {
+	err   error
+	cause error
+}
+
+func (e *abortedError) Error() string {
+	return fmt.Sprintf("%v (retrying aborted: %v)", e.err, e.cause)
+}
+
+func (e *abortedError) Unwrap() error {
+	return e.err
+}
+
+func (e *abortedError) Is(target error) bool {
+	return errors.Is(e.cause, target)
+}
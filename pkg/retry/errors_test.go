@@ -0,0 +1,213 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPermanent(t *testing.T) {
+	require.Nil(t, Permanent(nil))
+	err := Permanent(syscall.ECONNRESET)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, syscall.ECONNRESET.Error(), err.Error())
+
+	calls := 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return Permanent(syscall.ECONNRESET)
+	}, &Options{MaxRetry: 3, Delay: time.Millisecond})
+	require.Equal(t, syscall.ECONNRESET, err)
+	require.Equal(t, 1, calls)
+
+	// A wrapped Permanent error stops the loop too, and is returned as is.
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("validating: %w", Permanent(syscall.ECONNRESET))
+	}, &Options{MaxRetry: 3, Delay: time.Millisecond, RetryablePredicate: func(error) bool { return true }})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetryable(t *testing.T) {
+	require.Nil(t, Retryable(nil))
+	notRetryable := errors.New("token expired")
+	err := Retryable(notRetryable)
+	require.ErrorIs(t, err, notRetryable)
+	require.Equal(t, notRetryable.Error(), err.Error())
+
+	calls := 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return Retryable(notRetryable)
+		}
+		return nil
+	}, &Options{MaxRetry: 3, Delay: time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return Retryable(notRetryable)
+	}, &Options{MaxRetry: 2, Delay: time.Millisecond, RetryablePredicate: func(error) bool { return false }})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, notRetryable, retryErr.LastErr)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return Retryable(Permanent(notRetryable))
+	}, &Options{MaxRetry: 2, Delay: time.Millisecond})
+	require.ErrorIs(t, err, notRetryable)
+	require.Equal(t, 1, calls)
+}
+
+func TestAborted(t *testing.T) {
+	cause := errors.New("shutting down")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	calls := 0
+	err := IfNecessary(ctx, func() error {
+		calls++
+		cancel(cause)
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Delay: time.Minute})
+	require.Equal(t, 1, calls)
+	require.Equal(t, syscall.ECONNRESET, errors.Unwrap(err))
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.ErrorIs(t, err, cause)
+	require.Contains(t, err.Error(), "shutting down")
+
+	ctx, cancelTimeout := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancelTimeout()
+	err = IfNecessary(ctx, func() error {
+		return syscall.ECONNRESET
+	}, &Options{Delay: time.Millisecond, MaxElapsedTime: time.Minute})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+
+	// Exhausting the retries is not reported as an abort.
+	err = IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 2, Delay: time.Millisecond})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, syscall.ECONNRESET, retryErr.LastErr)
+	require.NotErrorIs(t, err, context.Canceled)
+}
+
+func TestError(t *testing.T) {
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Clock: clock})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, &Error{
+		Attempts:  4,
+		Elapsed:   7 * time.Second,
+		SleepTime: 7 * time.Second,
+		LastDelay: 4 * time.Second,
+		LastErr:   syscall.ECONNRESET,
+	}, retryErr)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, "connection reset by peer", err.Error())
+
+	// Without any retry permitted, the error is returned as is.
+	for _, options := range []*Options{nil, {Clock: clock}} {
+		err = IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, options)
+		require.Equal(t, syscall.ECONNRESET, err)
+	}
+
+	// Failures that are not retried are returned as is.
+	failure := errors.New("not retryable")
+	err = IfNecessary(context.Background(), func() error {
+		return failure
+	}, &Options{MaxRetry: 3, Clock: clock})
+	require.Equal(t, failure, err)
+}
+
+func TestIsExhausted(t *testing.T) {
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.True(t, IsExhausted(fmt.Errorf("pulling: %w", err)))
+
+	// Not retried.
+	err = IfNecessary(context.Background(), func() error {
+		return syscall.EPERM
+	}, &Options{MaxRetry: 1, Clock: newFakeClock()})
+	require.Equal(t, syscall.EPERM, err)
+	require.False(t, IsExhausted(err))
+
+	// Canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	err = IfNecessary(ctx, func() error {
+		cancel()
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, Delay: time.Hour})
+	require.ErrorIs(t, err, context.Canceled)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.False(t, IsExhausted(err))
+
+	require.False(t, IsExhausted(nil))
+}
+
+func TestErrorAsErrcode(t *testing.T) {
+	unavailable := errcode.ErrorCodeUnavailable.WithMessage("registry is down")
+	tooManyRequests := errcode.ErrorCodeTooManyRequests.WithMessage("slow down")
+	for _, failure := range []error{
+		unavailable,
+		errcode.Errors{unavailable, tooManyRequests},
+		fmt.Errorf("fetching manifest: %w", unavailable),
+	} {
+		for _, aggregate := range []bool{false, true} {
+			err := IfNecessary(context.Background(), func() error {
+				return failure
+			}, &Options{MaxRetry: 2, AggregateErrors: aggregate, Clock: newFakeClock()})
+			require.True(t, IsExhausted(err), "%v", err)
+
+			var codeErr errcode.Error
+			require.ErrorAs(t, err, &codeErr)
+			require.Equal(t, errcode.ErrorCodeUnavailable, codeErr.Code)
+			require.Equal(t, http.StatusServiceUnavailable, codeErr.Code.Descriptor().HTTPStatusCode)
+
+			var codeErrs errcode.Errors
+			if _, ok := failure.(errcode.Errors); ok {
+				require.ErrorAs(t, err, &codeErrs)
+				require.Equal(t, failure, codeErrs)
+			} else {
+				require.False(t, errors.As(err, &codeErrs))
+			}
+		}
+	}
+}
+
+func TestErrorSleepAndExecTime(t *testing.T) {
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		// Every attempt takes 2 seconds.
+		<-clock.After(2 * time.Second)
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, BaseDelay: time.Second, Strategy: BackoffLinear, Clock: clock})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, 4, retryErr.Attempts)
+	require.Equal(t, (1+2+3)*time.Second, retryErr.SleepTime)
+	require.Equal(t, 4*2*time.Second, retryErr.ExecTime)
+	require.Equal(t, retryErr.SleepTime+retryErr.ExecTime, retryErr.Elapsed)
+}
@@ -0,0 +1,66 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// Group retries several operations concurrently with the same Options, like
+// errgroup.Group.  If an operation fails with an error that is not retried,
+// the context of the group is canceled, so that the retry loops of the other
+// operations stop instead of waiting for their next attempt; operations
+// failing with retryable errors do not affect the others.
+type Group struct {
+	retryer *Retryer
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mu   sync.Mutex
+	errs *multierror.Error
+}
+
+// NewGroup returns a Group retrying operations with a copy of options, until
+// ctx is done.  A nil options means operations are not retried.
+func NewGroup(ctx context.Context, options *Options) *Group {
+	ctx, cancel := context.WithCancel(ctx)
+	return &Group{
+		retryer: NewRetryer(options, nil),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Go retries the operation like IfNecessary in a new goroutine, with the
+// context of the group.
+func (g *Group) Go(operation func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		err := g.retryer.Do(g.ctx, operation)
+		if err == nil {
+			return
+		}
+		var aborted *abortedError
+		if !IsExhausted(err) && !errors.As(err, &aborted) {
+			g.cancel()
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		g.errs = multierror.Append(g.errs, err)
+	}()
+}
+
+// Wait waits for all the operations started with Go to end, and returns a
+// *multierror.Error holding the errors of those which failed, or nil if
+// all succeeded.
+func (g *Group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.errs.ErrorOrNil()
+}
@@ -0,0 +1,63 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroup(t *testing.T) {
+	g := NewGroup(context.Background(), &Options{MaxRetry: 2, Delay: time.Millisecond})
+	var calls int32
+	for i := 0; i < 5; i++ {
+		g.Go(func() error {
+			if atomic.AddInt32(&calls, 1) <= 3 {
+				return syscall.ECONNRESET
+			}
+			return nil
+		})
+	}
+	require.NoError(t, g.Wait())
+	require.Equal(t, int32(8), atomic.LoadInt32(&calls))
+
+	// Exhausted retries are collected without affecting the other operations.
+	g = NewGroup(context.Background(), &Options{MaxRetry: 1, Delay: time.Millisecond})
+	g.Go(func() error { return syscall.ECONNRESET })
+	g.Go(func() error { return nil })
+	err := g.Wait()
+	var multiErr *multierror.Error
+	require.ErrorAs(t, err, &multiErr)
+	require.Len(t, multiErr.Errors, 1)
+	require.True(t, IsExhausted(multiErr.Errors[0]))
+
+	// A failure that is not retried stops the other retry loops.
+	g = NewGroup(context.Background(), &Options{MaxRetry: 100, Delay: time.Hour})
+	failure := errors.New("not retryable")
+	started := make(chan struct{})
+	g.Go(func() error {
+		close(started)
+		return syscall.ECONNRESET
+	})
+	<-started
+	g.Go(func() error { return failure })
+	err = g.Wait()
+	require.ErrorAs(t, err, &multiErr)
+	require.Len(t, multiErr.Errors, 2)
+	require.ErrorIs(t, err, failure)
+	require.ErrorIs(t, err, context.Canceled)
+
+	// The parent context applies to all operations.
+	ctx, cancel := context.WithCancel(context.Background())
+	g = NewGroup(ctx, &Options{MaxRetry: 100, Delay: time.Hour})
+	g.Go(func() error {
+		cancel()
+		return syscall.ECONNRESET
+	})
+	require.ErrorIs(t, g.Wait(), context.Canceled)
+}
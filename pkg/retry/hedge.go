@@ -0,0 +1,51 @@
+package retry
+
+import "context"
+
+// run runs the operation for a single attempt, hedged if HedgeDelay is set.
+func (o *Options) run(ctx context.Context, operation func(ctx context.Context) error) error {
+	if o.RecoverPanics {
+		operation = recoverPanics(operation)
+	}
+	if o.SuccessPredicate != nil {
+		unfiltered := operation
+		operation = func(ctx context.Context) error {
+			if err := unfiltered(ctx); err != nil && !o.SuccessPredicate(err) {
+				return err
+			}
+			return nil
+		}
+	}
+	if o.HedgeDelay <= 0 {
+		return operation(ctx)
+	}
+	return o.hedge(ctx, operation)
+}
+
+// hedge runs the operation, and runs it a second time concurrently if the
+// first run does not return within HedgeDelay.  It returns nil as soon as a
+// run succeeds, canceling the other one, and otherwise the error of the run
+// that failed first.
+func (o *Options) hedge(ctx context.Context, operation func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan error, 2) // Buffered, so that the run not waited for can always finish.
+	run := func() {
+		results <- operation(ctx)
+	}
+	go run()
+	select {
+	case err := <-results:
+		return err
+	case <-o.getClock().After(o.HedgeDelay):
+	}
+	go run()
+	err := <-results
+	if err == nil {
+		return nil
+	}
+	if second := <-results; second == nil {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHedgeDelay(t *testing.T) {
+	// A slow first run is overtaken by the second one, and canceled.
+	var calls int32
+	canceled := make(chan struct{})
+	start := time.Now()
+	err := IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			select {
+			case <-ctx.Done():
+				close(canceled)
+				return ctx.Err()
+			case <-time.After(time.Minute):
+				return nil
+			}
+		}
+		return nil
+	}, &Options{HedgeDelay: 10 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+	require.Less(t, time.Since(start), time.Minute)
+	<-canceled
+
+	// A fast failure of one run does not end the attempt.
+	failure := errors.New("not retryable")
+	atomic.StoreInt32(&calls, 0)
+	err = IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			time.Sleep(20 * time.Millisecond)
+			return nil
+		}
+		return failure
+	}, &Options{HedgeDelay: time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&calls))
+
+	// An attempt fails, and is classified, only if both runs fail.
+	atomic.StoreInt32(&calls, 0)
+	err = IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(5 * time.Millisecond)
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, Delay: time.Millisecond, HedgeDelay: time.Millisecond})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, int32(4), atomic.LoadInt32(&calls))
+
+	// No second run is started for a fast attempt.
+	atomic.StoreInt32(&calls, 0)
+	err = IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}, &Options{HedgeDelay: time.Minute})
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,251 @@
+package retry
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+)
+
+// StatusCoder is implemented by errors reporting the HTTP status code of a
+// failed request.  IsRetryable uses it to retry 429 Too Many Requests and the
+// 5xx server errors, e.g. 500 Internal Server Error or 503 Service
+// Unavailable, except those which no retry can fix, e.g. 501 Not Implemented
+// or 505 HTTP Version Not Supported, and not the other status codes.  408
+// Request Timeout, e.g. returned by proxies when the upstream is briefly
+// slow, is only retried if the Idempotent option is set.  HTTP clients
+// wrapping non-2xx responses into errors can implement it to have them
+// classified correctly, even when wrapped in a *url.Error.
+//
+// When a proxy refuses to open a CONNECT tunnel, the net/http client only
+// reports the reason phrase of its response in a *url.Error.  IsRetryable
+// maps the standard phrases to their status codes, so that 502 Bad Gateway,
+// 503 Service Unavailable and 504 Gateway Timeout are retried, and 407 Proxy
+// Authentication Required is not.  For proxies using other phrases, map
+// them to an error implementing StatusCoder, e.g. in a RoundTripper.
+// Failures to connect to the proxy itself are classified like other network
+// errors.
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// isStatusCodeRetryable returns true if a request failing with the HTTP
+// status code may succeed when repeated.
+func isStatusCodeRetryable(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusNotImplemented, http.StatusHTTPVersionNotSupported, http.StatusNotExtended:
+		// The server does not support the request: it will be refused again.
+		return false
+	case http.StatusVariantAlsoNegotiates, http.StatusLoopDetected, http.StatusNetworkAuthenticationRequired:
+		// A configuration problem of the server or of the network, which
+		// needs to be fixed before the request can succeed.
+		return false
+	}
+	return code >= 500 && code < 600
+}
+
+// proxyConnectStatus returns the status code of the response of a proxy
+// refusing to open a CONNECT tunnel, if err is the error the net/http client
+// reports for it, holding only the standard reason phrase.
+func proxyConnectStatus(err error) (int, bool) {
+	if errors.Unwrap(err) != nil {
+		return 0, false
+	}
+	for _, code := range []int{http.StatusProxyAuthRequired, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout} {
+		if err.Error() == http.StatusText(code) {
+			return code, true
+		}
+	}
+	return 0, false
+}
+
+// isRequestTimeout returns true if err reports a 408 Request Timeout response.
+func isRequestTimeout(err error) bool {
+	var statusCode StatusCoder
+	return errors.As(err, &statusCode) && statusCode.StatusCode() == http.StatusRequestTimeout
+}
+
+// isMalformedResponse returns true if err, or an error it wraps, is one of the
+// errors the net/http client returns when it cannot parse the status line of
+// a response, e.g. "malformed HTTP response".  They have no distinct type.
+func isMalformedResponse(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if strings.HasPrefix(err.Error(), "malformed HTTP ") {
+			return true
+		}
+	}
+	return false
+}
+
+// RequestSentReporter is implemented by errors reporting whether the request
+// of a failed operation may have been received by the server, e.g. because a
+// response was received, as opposed to failures to connect.  Unless
+// Idempotent is set, an error reporting a sent request is never retried,
+// because repeating a request which is not idempotent, e.g. a POST creating
+// a resource, could repeat its side effects.  Errors which do not implement
+// it are assumed to have happened before the request was sent.
+type RequestSentReporter interface {
+	RequestSent() bool
+}
+
+// sentError marks an error as having happened after the request was sent.
+type sentError struct {
+	err error
+}
+
+// Sent wraps err so that it reports that the request of the operation may
+// have been received by the server, see RequestSentReporter.  Sent returns
+// nil if err is nil.
+func Sent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &sentError{err: err}
+}
+
+func (e *sentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *sentError) Unwrap() error {
+	return e.err
+}
+
+func (e *sentError) RequestSent() bool {
+	return true
+}
+
+// requestSent returns true if err reports that the request may have been sent.
+func requestSent(err error) bool {
+	var sent RequestSentReporter
+	return errors.As(err, &sent) && sent.RequestSent()
+}
+
+// MaintenanceDelay returns a function which can be used as the DelayForError
+// option to wait at least min, instead of the computed backoff, before
+// retrying a 503 Service Unavailable response, e.g. from a registry in
+// scheduled maintenance: an errcode.Error or errcode.ErrorCode, or one in an
+// errcode.Errors, with the ErrorCodeUnavailable code, or a StatusCoder
+// reporting 503.  Other errors use the usual backoff.
+func MaintenanceDelay(min time.Duration) func(err error, attempt int) (time.Duration, bool) {
+	return func(err error, _ int) (time.Duration, bool) {
+		return min, isServiceUnavailable(err)
+	}
+}
+
+// isServiceUnavailable returns true if err reports a 503 Service Unavailable
+// response.
+func isServiceUnavailable(err error) bool {
+	var (
+		errs       errcode.Errors
+		e          errcode.Error
+		code       errcode.ErrorCode
+		statusCode StatusCoder
+	)
+	switch {
+	case errors.As(err, &errs):
+		for _, e := range errs {
+			if isServiceUnavailable(e) {
+				return true
+			}
+		}
+		return false
+	case errors.As(err, &e):
+		return e.Code == errcode.ErrorCodeUnavailable
+	case errors.As(err, &code):
+		return code == errcode.ErrorCodeUnavailable
+	case errors.As(err, &statusCode):
+		return statusCode.StatusCode() == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// DockerRetryAfter extracts the delay requested by a registry from a docker
+// distribution errcode.Error, or the first one in an errcode.Errors, with the
+// ErrorCodeTooManyRequests or ErrorCodeUnavailable code.  The delay is read
+// from a "Retry-After" entry of the error detail, which can be an
+// http.Header, or a map as decoded from a JSON error response, holding a
+// number of seconds or an HTTP-date, relative to the current time.  It can be
+// used as the RetryAfter option; use DockerRetryAfterWithClock instead if the
+// Clock option is set.
+func DockerRetryAfter(err error) (time.Duration, bool) {
+	return dockerRetryAfter(err, time.Now())
+}
+
+// DockerRetryAfterWithClock returns a function which can be used as the
+// RetryAfter option like DockerRetryAfter, with HTTP-dates relative to the
+// time of clock, e.g. the Clock option.
+func DockerRetryAfterWithClock(clock Clock) func(err error) (time.Duration, bool) {
+	return func(err error) (time.Duration, bool) {
+		return dockerRetryAfter(err, clock.Now())
+	}
+}
+
+// dockerRetryAfter implements DockerRetryAfter, with HTTP-dates relative to
+// now.
+func dockerRetryAfter(err error, now time.Time) (time.Duration, bool) {
+	var errs errcode.Errors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			if delay, ok := dockerRetryAfter(e, now); ok {
+				return delay, true
+			}
+		}
+		return 0, false
+	}
+	var e errcode.Error
+	if !errors.As(err, &e) || (e.Code != errcode.ErrorCodeTooManyRequests && e.Code != errcode.ErrorCodeUnavailable) {
+		return 0, false
+	}
+	switch detail := e.Detail.(type) {
+	case http.Header:
+		return parseRetryAfter(detail.Get("Retry-After"), now)
+	case map[string]string:
+		for key, value := range detail {
+			if strings.EqualFold(key, "Retry-After") {
+				return parseRetryAfter(value, now)
+			}
+		}
+	case map[string]interface{}:
+		for key, value := range detail {
+			if !strings.EqualFold(key, "Retry-After") {
+				continue
+			}
+			switch v := value.(type) {
+			case string:
+				return parseRetryAfter(v, now)
+			case float64: // JSON numbers
+				if v >= 0 {
+					return time.Duration(v * float64(time.Second)), true
+				}
+			}
+		}
+	}
+	return 0, false
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either a number
+// of seconds or an HTTP-date, which is relative to now.  A date in the past
+// means no delay.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
@@ -0,0 +1,351 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/registry/api/errcode"
+	"github.com/stretchr/testify/require"
+)
+
+type statusError int
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("unexpected status %d", int(e))
+}
+
+func (e statusError) StatusCode() int {
+	return int(e)
+}
+
+func TestIsRetryableStatusCode(t *testing.T) {
+	for _, tc := range []struct {
+		code      int
+		retryable bool
+	}{
+		{http.StatusTooManyRequests, true},
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusRequestTimeout, false},
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusInternalServerError, true},
+		{http.StatusInsufficientStorage, true},
+		{520, true},
+		{http.StatusNotImplemented, false},
+		{http.StatusHTTPVersionNotSupported, false},
+		{http.StatusLoopDetected, false},
+		{http.StatusNetworkAuthenticationRequired, false},
+	} {
+		err := statusError(tc.code)
+		require.Equal(t, tc.retryable, IsRetryable(err), "%d", tc.code)
+		urlErr := &url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: err}
+		require.Equal(t, tc.retryable, IsRetryable(urlErr), "%d", tc.code)
+		require.Equal(t, tc.retryable, IsRetryable(fmt.Errorf("pulling: %w", urlErr)), "%d", tc.code)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		err                  error
+		idempotent, retrying bool
+	}{
+		{statusError(http.StatusRequestTimeout), false, false},
+		{statusError(http.StatusRequestTimeout), true, true},
+		{&url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: statusError(http.StatusRequestTimeout)}, true, true},
+		{Sent(statusError(http.StatusRequestTimeout)), true, true},
+		{statusError(http.StatusBadRequest), true, false},
+	} {
+		calls := 0
+		err := IfNecessary(context.Background(), func() error {
+			calls++
+			return tc.err
+		}, &Options{MaxRetry: 1, Idempotent: tc.idempotent, Clock: newFakeClock()})
+		require.Error(t, err)
+		if tc.retrying {
+			require.Equal(t, 2, calls, "%v", tc.err)
+		} else {
+			require.Equal(t, 1, calls, "%v", tc.err)
+		}
+	}
+}
+
+func TestDockerRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		delay time.Duration
+		ok    bool
+	}{
+		{errcode.ErrorCodeTooManyRequests.WithDetail(map[string]interface{}{"Retry-After": "30"}), 30 * time.Second, true},
+		{errcode.ErrorCodeTooManyRequests.WithDetail(map[string]interface{}{"retry-after": 2.5}), 2500 * time.Millisecond, true},
+		{errcode.ErrorCodeUnavailable.WithDetail(map[string]string{"Retry-After": "5"}), 5 * time.Second, true},
+		{errcode.ErrorCodeTooManyRequests.WithDetail(http.Header{"Retry-After": []string{"10"}}), 10 * time.Second, true},
+		{errcode.Errors{errcode.ErrorCodeUnknown, errcode.ErrorCodeTooManyRequests.WithDetail(map[string]string{"Retry-After": "7"})}, 7 * time.Second, true},
+		{fmt.Errorf("pulling: %w", errcode.ErrorCodeTooManyRequests.WithDetail(map[string]string{"Retry-After": "1"})), time.Second, true},
+		{errcode.ErrorCodeTooManyRequests.WithDetail(map[string]string{"Retry-After": "soon"}), 0, false},
+		{errcode.ErrorCodeTooManyRequests.WithDetail(map[string]string{"Retry-After": "-1"}), 0, false},
+		{errcode.ErrorCodeTooManyRequests.WithMessage("no detail"), 0, false},
+		{errcode.ErrorCodeDenied.WithDetail(map[string]string{"Retry-After": "30"}), 0, false},
+		{errors.New("other"), 0, false},
+	} {
+		delay, ok := DockerRetryAfter(tc.err)
+		require.Equal(t, tc.ok, ok, "%v", tc.err)
+		require.Equal(t, tc.delay, delay, "%v", tc.err)
+	}
+
+	var delays []time.Duration
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return errcode.ErrorCodeTooManyRequests.WithDetail(map[string]string{"Retry-After": "42"})
+		}
+		return nil
+	}, &Options{
+		MaxRetry:   1,
+		RetryAfter: DockerRetryAfter,
+		OnRetry:    func(_ int, delay time.Duration, _ error) { delays = append(delays, delay) },
+		Clock:      newFakeClock(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{42 * time.Second}, delays)
+
+	// HTTP-dates are relative to the Clock.
+	clock := newFakeClock()
+	retryAfter := DockerRetryAfterWithClock(clock)
+	for _, tc := range []struct {
+		detail interface{}
+		delay  time.Duration
+	}{
+		{map[string]string{"Retry-After": clock.Now().Add(time.Minute).Format(http.TimeFormat)}, time.Minute},
+		{map[string]interface{}{"Retry-After": clock.Now().Add(20 * time.Second).Format(http.TimeFormat)}, 20 * time.Second},
+		{http.Header{"Retry-After": []string{clock.Now().Add(-time.Minute).Format(http.TimeFormat)}}, 0},
+		{map[string]string{"Retry-After": "3"}, 3 * time.Second},
+	} {
+		delay, ok := retryAfter(errcode.ErrorCodeTooManyRequests.WithDetail(tc.detail))
+		require.True(t, ok, "%v", tc.detail)
+		require.Equal(t, tc.delay, delay, "%v", tc.detail)
+	}
+	<-clock.After(30 * time.Second)
+	delay, ok := retryAfter(errcode.Errors{errcode.ErrorCodeUnavailable.WithDetail(map[string]string{"Retry-After": clock.Now().Add(10 * time.Second).Format(http.TimeFormat)})})
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, delay)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{"Sat, 01 Apr 2023 00:00:30 GMT", 30 * time.Second, true},
+		{"Saturday, 01-Apr-23 00:01:00 GMT", time.Minute, true},
+		{"Sat Apr  1 00:00:05 2023", 5 * time.Second, true},
+		// A date in the past means no delay.
+		{"Fri, 31 Mar 2023 23:59:00 GMT", 0, true},
+		{"-1", 0, false},
+		{"1.5", 0, false},
+		{"tomorrow", 0, false},
+		{"", 0, false},
+	} {
+		delay, ok := parseRetryAfter(tc.value, now)
+		require.Equal(t, tc.ok, ok, "%q", tc.value)
+		require.Equal(t, tc.delay, delay, "%q", tc.value)
+	}
+
+	// A malformed value falls back to the computed backoff.
+	for _, value := range []string{"Sat, 01 Apr 2023 00:00:30 GMT", "soon"} {
+		clock := newFakeClock()
+		calls := 0
+		err := IfNecessary(context.Background(), func() error {
+			calls++
+			if calls == 1 {
+				return errcode.ErrorCodeTooManyRequests.WithDetail(map[string]string{"Retry-After": value})
+			}
+			return nil
+		}, &Options{
+			MaxRetry: 1,
+			RetryAfter: func(err error) (time.Duration, bool) {
+				var e errcode.Error
+				require.ErrorAs(t, err, &e)
+				return parseRetryAfter(e.Detail.(map[string]string)["Retry-After"], clock.Now())
+			},
+			Clock: clock,
+		})
+		require.NoError(t, err)
+		if value == "soon" {
+			require.Equal(t, []time.Duration{time.Second}, clock.Slept())
+		} else {
+			require.Equal(t, []time.Duration{30 * time.Second}, clock.Slept())
+		}
+	}
+}
+
+func TestMaintenanceDelay(t *testing.T) {
+	delayFor := MaintenanceDelay(5 * time.Minute)
+	for _, tc := range []struct {
+		err error
+		ok  bool
+	}{
+		{errcode.ErrorCodeUnavailable.WithMessage("maintenance"), true},
+		{errcode.Errors{errcode.ErrorCodeUnknown, errcode.ErrorCodeUnavailable}, true},
+		{&url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: statusError(http.StatusServiceUnavailable)}, true},
+		{errcode.ErrorCodeTooManyRequests, false},
+		{statusError(http.StatusBadGateway), false},
+		{syscall.ECONNRESET, false},
+	} {
+		delay, ok := delayFor(tc.err, 1)
+		require.Equal(t, tc.ok, ok, "%v", tc.err)
+		if ok {
+			require.Equal(t, 5*time.Minute, delay)
+		}
+	}
+
+	maintenance := errcode.ErrorCodeUnavailable.WithMessage("maintenance")
+	failures := []error{syscall.ECONNRESET, maintenance, maintenance, syscall.ECONNRESET}
+	calls := 0
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		if calls == len(failures) {
+			return nil
+		}
+		calls++
+		return failures[calls-1]
+	}, &Options{MaxRetry: len(failures), BaseDelay: time.Second, DelayForError: delayFor, Clock: clock})
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{time.Second, 5 * time.Minute, 5 * time.Minute, 8 * time.Second}, clock.Slept())
+}
+
+func TestIdempotent(t *testing.T) {
+	for _, tc := range []struct {
+		err                  error
+		idempotent, retrying bool
+	}{
+		// Failures to connect are retried whether the operation is idempotent or not.
+		{syscall.ECONNREFUSED, false, true},
+		{syscall.ECONNREFUSED, true, true},
+		// Failures after sending the request only if it is.
+		{Sent(statusError(http.StatusServiceUnavailable)), false, false},
+		{Sent(statusError(http.StatusServiceUnavailable)), true, true},
+		{fmt.Errorf("creating: %w", Sent(syscall.ECONNRESET)), false, false},
+		{Retryable(Sent(errors.New("unknown"))), false, false},
+		{Retryable(Sent(errors.New("unknown"))), true, true},
+		{Sent(syscall.EPERM), true, false},
+	} {
+		calls := 0
+		err := IfNecessary(context.Background(), func() error {
+			calls++
+			return tc.err
+		}, &Options{MaxRetry: 1, Idempotent: tc.idempotent, Clock: newFakeClock()})
+		require.Error(t, err)
+		if tc.retrying {
+			require.Equal(t, 2, calls, "%v", tc.err)
+		} else {
+			require.Equal(t, 1, calls, "%v", tc.err)
+		}
+	}
+	require.Nil(t, Sent(nil))
+	require.True(t, requestSent(Sent(syscall.ECONNRESET)))
+	require.False(t, requestSent(syscall.ECONNRESET))
+}
+
+func TestIsRetryableMalformedResponse(t *testing.T) {
+	for _, err := range []error{
+		textproto.ProtocolError("malformed MIME header line: garbage"),
+		errors.New(`malformed HTTP response "garbage"`),
+		&url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: fmt.Errorf("net/http: HTTP/1.x transport connection broken: %w", errors.New(`malformed HTTP status code "abc"`))},
+	} {
+		require.True(t, IsRetryable(err), "%v", err)
+	}
+	require.False(t, IsRetryable(errors.New("malformed manifest")))
+
+	for _, garbage := range []string{
+		"garbage\r\n\r\n",
+		"HTTP/1.1 abc OK\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nbad header line\r\n\r\n",
+	} {
+		// The server writes garbage once, then recovers.
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		go func() {
+			for i := 0; ; i++ {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_, _ = conn.Read(make([]byte, 4096))
+				if i == 0 {
+					_, _ = conn.Write([]byte(garbage))
+				} else {
+					_, _ = conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+				}
+				conn.Close()
+			}
+		}()
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		calls := 0
+		err = IfNecessary(context.Background(), func() error {
+			calls++
+			resp, err := client.Get("http://" + listener.Addr().String())
+			if err != nil {
+				return err
+			}
+			return resp.Body.Close()
+		}, &Options{MaxRetry: 2, Clock: newFakeClock()})
+		require.NoError(t, err, "%q", garbage)
+		require.Equal(t, 2, calls, "%q", garbage)
+		listener.Close()
+	}
+}
+
+func TestIsRetryableProxyConnect(t *testing.T) {
+	for _, tc := range []struct {
+		code      int
+		retryable bool
+	}{
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusProxyAuthRequired, false},
+		{http.StatusForbidden, false},
+	} {
+		proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			require.Equal(t, http.MethodConnect, r.Method)
+			w.WriteHeader(tc.code)
+		}))
+		proxyURL, err := url.Parse(proxy.URL)
+		require.NoError(t, err)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		_, err = client.Get("https://registry.example/v2/")
+		require.Error(t, err)
+		require.Equal(t, tc.retryable, IsRetryable(err), "%d: %v", tc.code, err)
+		proxy.Close()
+
+		// The phrases are only recognized in the *url.Error of the client.
+		require.False(t, IsRetryable(errors.New(http.StatusText(tc.code))), "%d", tc.code)
+	}
+
+	// The proxy is down.
+	proxy := httptest.NewServer(http.NotFoundHandler())
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	proxy.Close()
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	_, err = client.Get("https://registry.example/v2/")
+	require.Error(t, err)
+	require.True(t, IsRetryable(err), "%v", err)
+}
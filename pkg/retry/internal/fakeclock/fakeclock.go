@@ -0,0 +1,59 @@
+// Package fakeclock implements the simulated clock shared by retry.Plan, the
+// tests of the retry package and retrytest.FakeClock.
+package fakeclock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is a retry.Clock whose After returns immediately, advancing the
+// current time by the requested duration.
+type Clock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+// New returns a Clock starting at now.
+func New(now time.Time) *Clock {
+	return &Clock{now: now}
+}
+
+// Now returns the current simulated time.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Since returns the simulated time elapsed since t.
+func (c *Clock) Since(t time.Time) time.Duration {
+	return c.Now().Sub(t)
+}
+
+// After advances the simulated time by d, and returns a channel which is
+// ready to receive it.
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.slept = append(c.slept, d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+// Advance advances the simulated time by d without recording a sleep.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Slept returns the durations passed to After so far.
+func (c *Clock) Slept() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]time.Duration(nil), c.slept...)
+}
@@ -0,0 +1,31 @@
+package retry
+
+// Metrics records statistics about retry loops.  Implementations must be
+// safe for concurrent use if the Options are shared.
+type Metrics interface {
+	// IncRetry is called before every retry, with its 1-based number.
+	IncRetry(attempt int)
+	// ObserveAttempts is called when a retry loop ends, with the number of
+	// attempts of the operation that were made.
+	ObserveAttempts(n int)
+	// IncExhausted is called when a retry loop ends because no retries are
+	// left while the operation is still failing with a retryable error.
+	IncExhausted()
+}
+
+// noopMetrics is the Metrics used if none is set.
+type noopMetrics struct{}
+
+func (noopMetrics) IncRetry(int) {}
+
+func (noopMetrics) ObserveAttempts(int) {}
+
+func (noopMetrics) IncExhausted() {}
+
+// metrics returns the Metrics to record the retries to.
+func (o *Options) metrics() Metrics {
+	if o.Metrics != nil {
+		return o.Metrics
+	}
+	return noopMetrics{}
+}
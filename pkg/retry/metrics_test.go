@@ -0,0 +1,46 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testMetrics struct {
+	retries   []int
+	attempts  []int
+	exhausted int
+}
+
+func (m *testMetrics) IncRetry(attempt int) {
+	m.retries = append(m.retries, attempt)
+}
+
+func (m *testMetrics) ObserveAttempts(n int) {
+	m.attempts = append(m.attempts, n)
+}
+
+func (m *testMetrics) IncExhausted() {
+	m.exhausted++
+}
+
+func TestMetrics(t *testing.T) {
+	metrics := &testMetrics{}
+	options := &Options{MaxRetry: 2, Metrics: metrics, Clock: newFakeClock()}
+
+	err := IfNecessary(context.Background(), func() error { return nil }, options)
+	require.NoError(t, err)
+
+	err = IfNecessary(context.Background(), func() error { return syscall.ECONNRESET }, options)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+
+	err = IfNecessary(context.Background(), func() error { return errors.New("not retryable") }, options)
+	require.Error(t, err)
+
+	require.Equal(t, []int{1, 2}, metrics.retries)
+	require.Equal(t, []int{1, 3, 1}, metrics.attempts)
+	require.Equal(t, 1, metrics.exhausted)
+}
@@ -0,0 +1,168 @@
+package retry
+
+import (
+	"context"
+	"reflect"
+	"time"
+)
+
+// Option configures Options built by NewOptions.
+type Option func(*Options)
+
+// DefaultMaxRetry is the MaxRetry of the Options built by NewOptions, unless
+// one of opts sets it, e.g. WithMaxRetry(0) to disable retries.  It does not
+// apply to Options built otherwise, e.g. with a struct literal, in which an
+// unset MaxRetry means that the operation is not retried.
+var DefaultMaxRetry = 3
+
+// NewOptions returns Options configured by opts, starting from a MaxRetry of
+// DefaultMaxRetry.  Unlike struct literals, this keeps working unchanged when
+// new fields are added to Options.
+func NewOptions(opts ...Option) *Options {
+	options := &Options{MaxRetry: DefaultMaxRetry}
+	for _, opt := range opts {
+		opt(options)
+	}
+	return options
+}
+
+// With returns a copy of o in which the fields set in overrides replace those
+// of o, e.g. to adjust the policy of a client for a single call.  A field is
+// set if it is not the zero value of its type, so overrides cannot reset a
+// field of o to zero, e.g. turn Jitter off; change the returned copy for
+// that.  Maps and slices of overrides replace those of o as a whole.
+func (o *Options) With(overrides *Options) *Options {
+	merged := Options{}
+	if o != nil {
+		merged = *o
+	}
+	if overrides == nil {
+		return &merged
+	}
+	dst := reflect.ValueOf(&merged).Elem()
+	src := reflect.ValueOf(overrides).Elem()
+	for i := 0; i < src.NumField(); i++ {
+		if dst.Type().Field(i).IsExported() && !src.Field(i).IsZero() {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+	return &merged
+}
+
+// IfNecessaryWithOptions retries the operation like IfNecessary, with the
+// Options configured by opts.
+func IfNecessaryWithOptions(ctx context.Context, operation func() error, opts ...Option) error {
+	return IfNecessary(ctx, operation, NewOptions(opts...))
+}
+
+// DefaultOptions returns the recommended Options: 5 retries with full jitter
+// applied to an exponential backoff starting at 1 second and capped at 30
+// seconds.
+func DefaultOptions() *Options {
+	return NewOptions(
+		WithMaxRetry(5),
+		WithBaseDelay(time.Second),
+		WithMaxDelay(30*time.Second),
+		WithJitter(),
+	)
+}
+
+// WithMaxRetry sets the number of times to possibly retry, instead of
+// DefaultMaxRetry.
+func WithMaxRetry(n int) Option {
+	return func(o *Options) {
+		o.MaxRetry = n
+	}
+}
+
+// WithDelay sets a fixed delay to use between retries.
+func WithDelay(d time.Duration) Option {
+	return func(o *Options) {
+		o.Delay = d
+	}
+}
+
+// WithBaseDelay sets the initial exponential backoff delay.
+func WithBaseDelay(d time.Duration) Option {
+	return func(o *Options) {
+		o.BaseDelay = d
+	}
+}
+
+// WithMaxDelay sets the upper bound of the backoff delay.
+func WithMaxDelay(d time.Duration) Option {
+	return func(o *Options) {
+		o.MaxDelay = d
+	}
+}
+
+// WithJitter enables full jitter of the backoff delays.
+func WithJitter() Option {
+	return func(o *Options) {
+		o.Jitter = true
+	}
+}
+
+// WithMaxDelayJitterSpread sets EquilibriumJitter, spreading the delays which
+// reached MaxDelay by the fraction spread of MaxDelay.
+func WithMaxDelayJitterSpread(spread float64) Option {
+	return func(o *Options) {
+		o.EquilibriumJitter = spread
+	}
+}
+
+// WithFactor sets the exponential backoff multiplier.
+func WithFactor(factor float64) Option {
+	return func(o *Options) {
+		o.Factor = factor
+	}
+}
+
+// WithStrategy sets the algorithm computing the delays.
+func WithStrategy(strategy BackoffStrategy) Option {
+	return func(o *Options) {
+		o.Strategy = strategy
+	}
+}
+
+// WithMaxElapsedTime sets the time after which retrying stops.
+func WithMaxElapsedTime(d time.Duration) Option {
+	return func(o *Options) {
+		o.MaxElapsedTime = d
+	}
+}
+
+// WithAttemptTimeout sets the timeout of each attempt.
+func WithAttemptTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.AttemptTimeout = d
+	}
+}
+
+// WithRetryablePredicate sets the function deciding whether an error is retried.
+func WithRetryablePredicate(predicate func(error) bool) Option {
+	return func(o *Options) {
+		o.RetryablePredicate = predicate
+	}
+}
+
+// WithLogger sets the Logger receiving the messages about retries.
+func WithLogger(logger Logger) Option {
+	return func(o *Options) {
+		o.Logger = logger
+	}
+}
+
+// WithOnRetry sets the function called before each retry.
+func WithOnRetry(onRetry func(attempt int, delay time.Duration, err error)) Option {
+	return func(o *Options) {
+		o.OnRetry = onRetry
+	}
+}
+
+// WithClock sets the source of time, e.g. a retrytest.FakeClock.
+func WithClock(clock Clock) Option {
+	return func(o *Options) {
+		o.Clock = clock
+	}
+}
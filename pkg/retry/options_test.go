@@ -0,0 +1,136 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewOptions(t *testing.T) {
+	require.Equal(t, &Options{MaxRetry: DefaultMaxRetry}, NewOptions())
+	require.Equal(t, &Options{}, NewOptions(WithMaxRetry(0)))
+	require.Equal(t, &Options{
+		MaxRetry:  3,
+		BaseDelay: 50 * time.Millisecond,
+		MaxDelay:  time.Second,
+		Jitter:    true,
+	}, NewOptions(WithMaxRetry(3), WithBaseDelay(50*time.Millisecond), WithMaxDelay(time.Second), WithJitter()))
+
+	options := DefaultOptions()
+	require.NoError(t, options.Validate())
+	require.Equal(t, &Options{
+		MaxRetry:  5,
+		BaseDelay: time.Second,
+		MaxDelay:  30 * time.Second,
+		Jitter:    true,
+	}, options)
+}
+
+func TestOptionsWith(t *testing.T) {
+	logger := logrus.New()
+	base := &Options{
+		MaxRetry:  5,
+		BaseDelay: time.Second,
+		MaxDelay:  30 * time.Second,
+		Jitter:    true,
+		DoNotRetryOn: []error{
+			syscall.EPERM,
+		},
+		Logger: logger,
+	}
+	merged := base.With(&Options{MaxRetry: 1, AttemptTimeout: time.Minute, DoNotRetryOn: []error{syscall.EACCES}})
+	require.Equal(t, &Options{
+		MaxRetry:       1,
+		BaseDelay:      time.Second,
+		MaxDelay:       30 * time.Second,
+		Jitter:         true,
+		AttemptTimeout: time.Minute,
+		DoNotRetryOn:   []error{syscall.EACCES},
+		Logger:         logger,
+	}, merged)
+	// The base options are unchanged.
+	require.Equal(t, 5, base.MaxRetry)
+	require.Zero(t, base.AttemptTimeout)
+	require.Equal(t, []error{syscall.EPERM}, base.DoNotRetryOn)
+
+	// Zero fields are not overrides.
+	require.Equal(t, base, base.With(&Options{Jitter: false}))
+	require.Equal(t, base, base.With(nil))
+	require.NotSame(t, base, base.With(nil))
+	require.Equal(t, &Options{MaxRetry: 2}, (*Options)(nil).With(&Options{MaxRetry: 2}))
+}
+
+func TestIfNecessaryWithOptions(t *testing.T) {
+	unauthorized := errors.New("unauthorized")
+	clock := newFakeClock()
+	var retries []int
+	calls := 0
+	err := IfNecessaryWithOptions(context.Background(), func() error {
+		calls++
+		return unauthorized
+	},
+		WithMaxRetry(3),
+		WithBaseDelay(100*time.Millisecond),
+		WithFactor(3),
+		WithMaxDelay(time.Second),
+		WithRetryablePredicate(func(err error) bool { return errors.Is(err, unauthorized) }),
+		WithOnRetry(func(attempt int, _ time.Duration, _ error) { retries = append(retries, attempt) }),
+		WithClock(clock),
+	)
+	require.ErrorIs(t, err, unauthorized)
+	require.Equal(t, 4, calls)
+	require.Equal(t, []int{1, 2, 3}, retries)
+	require.Equal(t, []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond}, clock.Slept())
+
+	clock = newFakeClock()
+	calls = 0
+	err = IfNecessaryWithOptions(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, WithMaxRetry(2), WithDelay(time.Minute), WithStrategy(BackoffLinear), WithClock(clock))
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 3, calls)
+	require.Equal(t, []time.Duration{time.Minute, time.Minute}, clock.Slept())
+
+	// Without options, the operation is retried DefaultMaxRetry times.
+	calls = 0
+	err = IfNecessaryWithOptions(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, WithClock(newFakeClock()))
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 4, calls)
+
+	// An explicit zero disables the retries.
+	calls = 0
+	err = IfNecessaryWithOptions(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, WithMaxRetry(0))
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 1, calls)
+
+	// Options built otherwise do not inherit it.
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 1, calls)
+
+	// Changes of DefaultMaxRetry apply to the Options built later.
+	defer func(n int) { DefaultMaxRetry = n }(DefaultMaxRetry)
+	DefaultMaxRetry = 1
+	require.Equal(t, 1, NewOptions().MaxRetry)
+
+	options := NewOptions(WithMaxElapsedTime(time.Minute), WithAttemptTimeout(time.Second), WithLogger(logrus.New()))
+	require.Equal(t, time.Minute, options.MaxElapsedTime)
+	require.Equal(t, time.Second, options.AttemptTimeout)
+	require.NotNil(t, options.Logger)
+}
@@ -0,0 +1,39 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicError is the error of an attempt of an operation which panicked, if
+// RecoverPanics is set.  It is not retryable, unless RetryablePredicate
+// decides otherwise.  Its message does not include the stack trace, which
+// can be logged from Stack.
+type PanicError struct {
+	Value interface{} // The value passed to panic.
+	Stack []byte      // The stack trace of the goroutine which panicked.
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("operation panicked: %v", e.Value)
+}
+
+// Unwrap returns the value passed to panic if it is an error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// recoverPanics returns an operation running operation, and returning a
+// *PanicError if it panics.
+func recoverPanics(operation func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) (err error) {
+		defer func() {
+			if value := recover(); value != nil {
+				err = &PanicError{Value: value, Stack: debug.Stack()}
+			}
+		}()
+		return operation(ctx)
+	}
+}
@@ -0,0 +1,58 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverPanics(t *testing.T) {
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		panic("index out of range")
+	}, &Options{MaxRetry: 3, RecoverPanics: true, Clock: newFakeClock()})
+	require.Equal(t, 1, calls)
+	var panicErr *PanicError
+	require.ErrorAs(t, err, &panicErr)
+	require.Equal(t, "index out of range", panicErr.Value)
+	require.EqualError(t, err, "operation panicked: index out of range")
+	require.Contains(t, string(panicErr.Stack), "TestRecoverPanics")
+	require.False(t, IsExhausted(err))
+
+	// A panic with a retryable error is not retried either, but the error
+	// can be matched.
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		panic(syscall.ECONNRESET)
+	}, &Options{MaxRetry: 3, RecoverPanics: true, Clock: newFakeClock()})
+	require.Equal(t, 1, calls)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+
+	// RetryablePredicate can decide to retry panics.
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			panic("flaky")
+		}
+		return nil
+	}, &Options{
+		MaxRetry:           3,
+		RecoverPanics:      true,
+		RetryablePredicate: func(err error) bool { return errors.As(err, &panicErr) },
+		Clock:              newFakeClock(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	require.Panics(t, func() {
+		_ = IfNecessary(context.Background(), func() error {
+			panic("not recovered")
+		}, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	})
+}
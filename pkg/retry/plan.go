@@ -0,0 +1,34 @@
+package retry
+
+import (
+	"context"
+	"time"
+
+	"github.com/containers/common/pkg/retry/internal/fakeclock"
+)
+
+// Plan runs the operation like IfNecessary, but without waiting: the delays
+// before the retries only advance a simulated clock.  It returns every
+// attempt made, the last one carrying the error IfNecessary would return,
+// e.g. to explain or test how the errors of an operation are handled.  ctx
+// is checked as usual, and its deadline is compared to the simulated time.
+func Plan(ctx context.Context, operation func() error, options *Options) ([]Attempt, error) {
+	planOptions := Options{}
+	if options != nil {
+		planOptions = *options
+	}
+	var attempts []Attempt
+	onRetry := planOptions.OnRetry
+	planOptions.OnRetry = func(attempt int, delay time.Duration, err error) {
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		attempts = append(attempts, Attempt{Number: attempt, Err: err, Delay: delay})
+	}
+	planOptions.Clock = fakeclock.New(time.Now())
+	n, err := ifNecessary(ctx, func(context.Context) error {
+		return operation()
+	}, &planOptions)
+	attempts = append(attempts, Attempt{Number: n, Err: err})
+	return attempts, err
+}
@@ -0,0 +1,54 @@
+package retry
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlan(t *testing.T) {
+	failures := []error{syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.EPERM}
+	calls := 0
+	start := time.Now()
+	attempts, err := Plan(context.Background(), func() error {
+		calls++
+		return failures[calls-1]
+	}, &Options{MaxRetry: 5, BaseDelay: time.Hour})
+	require.Less(t, time.Since(start), time.Hour)
+	require.Equal(t, syscall.EPERM, err)
+	require.Equal(t, []Attempt{
+		{Number: 1, Err: syscall.ECONNRESET, Delay: time.Hour},
+		{Number: 2, Err: syscall.ETIMEDOUT, Delay: 2 * time.Hour},
+		{Number: 3, Err: syscall.EPERM},
+	}, attempts)
+
+	attempts, err = Plan(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Delay: time.Minute})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Len(t, attempts, 4)
+	require.Equal(t, err, attempts[3].Err)
+
+	// The deadline of ctx applies to the simulated time.
+	ctx, cancel := context.WithTimeout(context.Background(), 90*time.Minute)
+	defer cancel()
+	attempts, err = Plan(ctx, func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 5, BaseDelay: time.Hour})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, []Attempt{
+		{Number: 1, Err: syscall.ECONNRESET, Delay: time.Hour},
+		{Number: 2, Err: syscall.ECONNRESET, Delay: 0},
+		{Number: 3, Err: err},
+	}, attempts)
+
+	attempts, err = Plan(context.Background(), func() error {
+		return nil
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, []Attempt{{Number: 1}}, attempts)
+}
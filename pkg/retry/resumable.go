@@ -0,0 +1,36 @@
+package retry
+
+import "context"
+
+// Resumable retries an operation which makes partial progress, like a
+// download, with the retry Options, like IfNecessary.  Every attempt is
+// given the offset reached by the previous ones, e.g. to request the rest
+// of a blob with a Range header, and returns how many bytes it consumed in
+// addition, even if it fails.  Resumable returns the offset reached by all
+// the attempts, together with the error IfNecessary would return.  With
+// ResetOnProgress, an attempt consuming any bytes restarts the backoff.
+//
+// The attempts must not run concurrently, so HedgeDelay is ignored.
+func Resumable(ctx context.Context, operation func(offset int64) (int64, error), options *Options) (int64, error) {
+	resumableOptions := Options{}
+	if options != nil {
+		resumableOptions = *options
+	}
+	resumableOptions.HedgeDelay = 0
+	var (
+		offset     int64
+		progressed bool
+	)
+	resumableOptions.progressed = func() bool {
+		return progressed
+	}
+	err := IfNecessary(ctx, func() error {
+		n, err := operation(offset)
+		progressed = n > 0
+		if progressed {
+			offset += n
+		}
+		return err
+	}, &resumableOptions)
+	return offset, err
+}
@@ -0,0 +1,69 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResumable(t *testing.T) {
+	blob := []byte("0123456789abcdefghij")
+	var received bytes.Buffer
+	var offsets []int64
+	// Every attempt transfers up to 8 bytes before the connection resets.
+	total, err := Resumable(context.Background(), func(offset int64) (int64, error) {
+		offsets = append(offsets, offset)
+		rest := blob[offset:]
+		if len(rest) > 8 {
+			received.Write(rest[:8])
+			return 8, syscall.ECONNRESET
+		}
+		received.Write(rest)
+		return int64(len(rest)), nil
+	}, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, int64(len(blob)), total)
+	require.Equal(t, []int64{0, 8, 16}, offsets)
+	require.Equal(t, blob, received.Bytes())
+
+	// Without enough progress, the usual limits apply.
+	offsets = nil
+	total, err = Resumable(context.Background(), func(offset int64) (int64, error) {
+		offsets = append(offsets, offset)
+		return 1, io.ErrUnexpectedEOF
+	}, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Equal(t, int64(3), total)
+	require.Equal(t, []int64{0, 1, 2}, offsets)
+}
+
+func TestResetOnProgress(t *testing.T) {
+	// Attempts 3 and 5 make progress before failing.
+	progress := []int64{0, 0, 10, 0, 10, 0, 0}
+	for _, tc := range []struct {
+		resetOnProgress bool
+		delays          []time.Duration
+	}{
+		{false, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second}},
+		{true, []time.Duration{time.Second, 2 * time.Second, time.Second, 2 * time.Second, time.Second, 2 * time.Second}},
+	} {
+		clock := newFakeClock()
+		calls := 0
+		total, err := Resumable(context.Background(), func(int64) (int64, error) {
+			n := progress[calls]
+			calls++
+			return n, syscall.ECONNRESET
+		}, &Options{MaxRetry: len(progress) - 1, ResetOnProgress: tc.resetOnProgress, Clock: clock})
+		// The resets do not allow more attempts.
+		require.True(t, IsExhausted(err))
+		require.Equal(t, len(progress), calls)
+		require.Equal(t, int64(20), total)
+		require.Equal(t, tc.delays, clock.Slept())
+	}
+}
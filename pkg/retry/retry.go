@@ -2,25 +2,317 @@ package retry
 
 import (
 	"context"
-	"io"
-	"math"
-	"net"
-	"net/url"
-	"syscall"
+	"errors"
+	"fmt"
+	"math/rand"
 	"time"
 
 	"github.com/docker/distribution/registry/api/errcode"
-	errcodev2 "github.com/docker/distribution/registry/api/v2"
 	"github.com/hashicorp/go-multierror"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
 )
 
 // Options defines the option to retry.
 type Options struct {
-	MaxRetry int           // The number of times to possibly retry.
-	Delay    time.Duration // The delay to use between retries, if set.
+	MaxRetry  int             // The number of times to possibly retry; 0 runs the operation once.
+	Delay     time.Duration   // The delay to use between retries, if set.
+	BaseDelay time.Duration   // The initial exponential backoff delay, defaults to 1 second.
+	Factor    float64         // The exponential backoff multiplier, defaults to 2.
+	MaxDelay  time.Duration   // The upper bound of the exponential backoff delay, unbounded if not set.
+	Jitter    bool            // Randomize each delay within [0, delay) ("full jitter") to avoid synchronized retries.
+	Strategy  BackoffStrategy // The algorithm computing the delays, BackoffExponential by default.
+
+	// MaxAttempts, if set, is the total number of times the operation can
+	// be run, including the first attempt, so 1 never retries it.  It is
+	// an alternative to MaxRetry, which it overrides: MaxAttempts n is
+	// equivalent to MaxRetry n-1.
+	MaxAttempts int
+
+	// MaxJitter, if set, bounds how much Jitter and BackoffFullJitter can
+	// shorten a delay: they randomize it within [delay - MaxJitter, delay)
+	// instead of [0, delay), for predictable delays which are still not
+	// synchronized.
+	MaxJitter time.Duration
+
+	// AttemptOffset is added to the 0-based number of the failed attempt
+	// when computing the delay before the next retry, e.g. 1 makes the first
+	// exponential backoff BaseDelay * Factor instead of BaseDelay, to match
+	// the backoff of other systems.
+	AttemptOffset int
+	// ImmediateAttempts, if set, makes the first ImmediateAttempts retries
+	// happen without any delay, for glitches which a quick retry usually
+	// fixes; the backoff then starts from its first delay.  These retries
+	// count towards MaxRetry and MaxAttempts like the others.  A delay
+	// provided by RetryAfter or DelayForError still applies to them.
+	ImmediateAttempts int
+	// ResetOnProgress restarts the backoff from its first delay after an
+	// attempt which made progress, even if it failed, as reported by the
+	// operation of Resumable, so that stalls of a long transfer do not
+	// escalate to the longest delays.  MaxRetry and MaxAttempts still count
+	// all the attempts, only the delays are reset.  It is ignored outside of
+	// Resumable.
+	ResetOnProgress bool
+
+	// Idempotent declares that the operation can safely be repeated even
+	// after its request was received by the server.  If it is not set,
+	// errors reporting a sent request through RequestSentReporter, e.g.
+	// wrapped by Sent, are never retried.  If it is set, 408 Request Timeout
+	// responses are retried too, see StatusCoder.
+	Idempotent bool
+
+	// InitialDelay, if set, is waited before the first attempt of the
+	// operation, e.g. to stagger the start of many processes.  Unlike
+	// BaseDelay, it does not affect the delays between retries.  It is
+	// randomized within [0, InitialDelay) if Jitter is set.
+	InitialDelay time.Duration
+	// SpreadStartup, if set, delays the first attempt of the operation by
+	// a random duration in [0, SpreadStartup), in addition to InitialDelay,
+	// so that many processes starting at the same time do not all hit the
+	// same service at once.  Unlike Jitter, it does not affect the retries.
+	SpreadStartup time.Duration
+	// JitterFirstAttemptOnly randomizes when the first attempt of the
+	// operation starts, e.g. to avoid a stampede on a cache after a cold
+	// start, while keeping the delays between retries predictable: the first
+	// attempt waits a random duration within [0, InitialDelay) if InitialDelay
+	// is set, or within [0, BaseDelay) otherwise, plus SpreadStartup if set,
+	// and Jitter is not applied to the retries.  The delays reaching MaxDelay
+	// are still spread, see EquilibriumJitter.
+	JitterFirstAttemptOnly bool
+
+	// RetryablePredicate, if set, replaces IsRetryable to decide whether
+	// an error returned by the operation is retried.
+	RetryablePredicate func(error) bool
+	// SuccessPredicate, if set, is called with the error of every failed
+	// attempt, and if it returns true, the attempt is considered successful
+	// and the retry loop returns nil, e.g. when polling until a server
+	// returns a specific error.  It takes precedence over all the other
+	// options classifying errors.
+	SuccessPredicate func(error) bool
+	// RetryableCodes, if not nil, lists the docker distribution error codes
+	// which IsRetryable would classify as retryable, instead of the built-in
+	// ones (ErrorCodeUnknown, ErrorCodeUnavailable and
+	// ErrorCodeTooManyRequests), e.g. for registries with unusual error
+	// semantics.  Codes mapped to false, or missing, are not retried.
+	RetryableCodes map[errcode.ErrorCode]bool
+	// AnyRetryable makes a group of errors, a *multierror.Error or an
+	// errcode.Errors, retryable if any of its members is, e.g. if one of
+	// several endpoints failed transiently, instead of all of them.
+	AnyRetryable bool
+	// RetryOn, if not empty, restricts the retries to errors matching one
+	// of its elements according to errors.Is.  It takes precedence over
+	// RetryablePredicate and IsRetryable.
+	RetryOn []error
+	// DoNotRetryOn lists errors that are never retried, matched using
+	// errors.Is.  It takes precedence over everything else, including
+	// RetryOn, RetryablePredicate and errors wrapped by Retryable.
+	DoNotRetryOn []error
+	// MaxConsecutiveSameError, if set, stops retrying once that many
+	// consecutive attempts failed with the same error, as compared with
+	// errors.Is or by their messages, even if retries remain, because the
+	// operation is then likely stuck, e.g. misconfigured.  The error of the
+	// last attempt is returned.
+	MaxConsecutiveSameError int
+	// Logger, if set, receives the messages about retries instead of the
+	// standard logrus logger.
+	Logger Logger
+	// SlogLogger, if set, receives the messages about retries instead of
+	// Logger, e.g. a *slog.Logger of the log/slog package.  Every retry is
+	// reported as a structured record with the attributes "attempt", the
+	// 1-based retry number, "delay" and "error".
+	SlogLogger StructuredLogger
+	// Silent suppresses all the messages about retries, whatever the Logger
+	// and SlogLogger, e.g. in a library for which OnRetry is the only way
+	// to observe them.
+	Silent bool
+	// LogSampleRate, if greater than 1, logs only a random sample of about
+	// one in LogSampleRate retries, to limit the log volume when many
+	// operations are failing.  Every retry is logged if it is not set.
+	LogSampleRate int
+	// ExhaustedLogLevel, if set, logs a message at that level when the
+	// retries are exhausted, with the number of attempts, the elapsed time
+	// and the error of the last attempt, so that callers do not have to.
+	ExhaustedLogLevel LogLevel
+	// LogRecovered logs a message at the info level when the operation
+	// succeeds after being retried, with the number of retries.
+	LogRecovered bool
+	// OnRetry, if set, is called right before sleeping ahead of each retry,
+	// with the 1-based retry number, the delay and the error that caused it.
+	// The delay is the one actually waited, after jitter and shortening to
+	// the deadline of the context.
+	// It supplements the log message, which is always emitted.
+	OnRetry func(attempt int, delay time.Duration, err error)
+	// PreRetry, if set, is called once the error of a failed attempt has been
+	// found retryable, before sleeping ahead of the retry with the 1-based
+	// number given to OnRetry.  Returning false stops retrying, e.g. because
+	// a circuit breaker opened or refreshing a token failed, and the error of
+	// the last attempt is returned.
+	PreRetry func(ctx context.Context, attempt int, err error) bool
+	// ShouldGiveUp, if set, is called after every failed attempt which
+	// leaves a retry, before its error is classified, with that error, the
+	// number of attempts made so far and the time elapsed since the first
+	// one.  Returning true stops retrying immediately, whatever the
+	// classification of the error and the retries left, and the error of the
+	// last attempt is returned.  It is called before Budget and PreRetry, to
+	// express combined conditions, e.g. giving up after 2 seconds on 5xx
+	// responses once 2 attempts failed.
+	ShouldGiveUp func(err error, attempt int, elapsed time.Duration) bool
+	// StartAttempt, if set, is called before every attempt with its 1-based
+	// number, e.g. to start a tracing span for it.  The operation is given
+	// the returned context, and the returned function, if not nil, is called
+	// with the error of the attempt once it ends, e.g. to end the span.  Not
+	// setting it is a no-op.
+	StartAttempt func(ctx context.Context, attempt int) (context.Context, func(err error))
+	// Metrics, if set, records the retries, e.g. as Prometheus counters.
+	Metrics Metrics
+	// Budget, if set, is shared by many retry loops to limit their total
+	// number of retries.  A retry it does not allow is skipped, and the
+	// error of the last attempt is returned.
+	Budget Budget
+	// Limiter, if set, paces the retries: each one waits for a token from
+	// it after the delay, in addition to the backoff.  The limiter can be
+	// shared with the initial requests to a dependency to keep all of them
+	// within a single rate.  If the context ends, or its deadline would pass
+	// before a token is available, the loop is aborted.
+	Limiter *rate.Limiter
+	// CircuitBreaker, if set, is consulted before every attempt, including
+	// the first one, and told about the outcome of every attempt it allowed.
+	// If it does not allow an attempt, the loop returns ErrCircuitOpen
+	// without running the operation.
+	CircuitBreaker CircuitBreaker
+	// AggregateErrors makes a failed retry loop return a *multierror.Error
+	// holding the error of every attempt, in order, instead of only the last one.
+	// If the loop stopped because the error of the last attempt was not
+	// retryable, that error is wrapped in a *FatalError.
+	AggregateErrors bool
+	// RetryAfter, if set, can extract a server-provided delay (e.g. from a
+	// Retry-After header) from the error of a failed attempt. If it returns
+	// true, that delay is used as is for the next retry instead of the
+	// computed backoff.
+	RetryAfter func(error) (time.Duration, bool)
+	// DelayForError, if set, can choose the delay ahead of a retry depending
+	// on the error of the failed attempt and the 1-based retry number, e.g.
+	// retrying a connection reset almost immediately while backing off
+	// exponentially from other errors.  If it returns true, that delay is
+	// used as is, without jitter and regardless of MaxDelay, instead of the
+	// computed backoff.  A delay found by RetryAfter takes precedence.
+	DelayForError func(err error, attempt int) (time.Duration, bool)
+	// ReturnLastResult makes IfNecessaryWithValidator return the last result
+	// rejected by the validator, if any, instead of the zero value, when ctx
+	// is done before a result is accepted, so that callers can settle for a
+	// degraded result.  The error is returned as well.  It is ignored in other
+	// cases, and outside of IfNecessaryWithValidator.
+	ReturnLastResult bool
+	// AttemptTimeout, if set, bounds the duration of each attempt made by
+	// IfNecessaryCtx: the operation gets a context that expires after
+	// AttemptTimeout, or earlier if the parent context expires first. An
+	// attempt failing with context.DeadlineExceeded because its own timeout
+	// expired is always retried, while the expiration of the parent context
+	// still ends the retry loop.
+	AttemptTimeout time.Duration
+	// MaxElapsedTime, if set, stops retrying once that much time has passed
+	// since the first attempt of the operation started, as measured by the
+	// monotonic clock, unaffected by changes of the system time.  It applies in
+	// addition to MaxRetry or MaxAttempts, unless neither is set, in which
+	// case only MaxElapsedTime limits the number of retries.
+	MaxElapsedTime time.Duration
+	// MaxTotalDelay, if set, stops retrying once the sum of the delays
+	// slept between attempts would exceed it.  Unlike MaxElapsedTime, it
+	// ignores the time spent running the operation.  It applies in addition
+	// to MaxRetry.
+	MaxTotalDelay time.Duration
+	// MinInterval, if set, is the minimum time between the starts of
+	// consecutive attempts, e.g. for politeness toward a fragile API: if an
+	// attempt and the delay after it take less time, the delay is extended
+	// accordingly.  It is measured with Clock.
+	MinInterval time.Duration
+	// RandomizationFactor, if set to a fraction in (0, 1], randomizes every
+	// delay uniformly within [delay*(1-RandomizationFactor),
+	// delay*(1+RandomizationFactor)), as does the RandomizationFactor of
+	// github.com/cenkalti/backoff, then caps it at MaxDelay.  It is ignored if
+	// Jitter is set, and by BackoffFullJitter and BackoffDecorrelated.
+	RandomizationFactor float64
+	// EquilibriumJitter, if set to a fraction in (0, 1], randomizes the
+	// delays once the backoff has reached MaxDelay within
+	// [MaxDelay*(1-EquilibriumJitter), MaxDelay*(1+EquilibriumJitter)), instead
+	// of applying Jitter, so that delays stay close to MaxDelay during a long
+	// outage without getting synchronized, e.g. to smear the retries of many
+	// clients once the outage ends instead of overloading the recovering
+	// service.  It defaults to 0.1 if Jitter is only applied to the first
+	// attempt by JitterFirstAttemptOnly.  It is ignored by
+	// BackoffDecorrelated, and if MaxDelay is not set.
+	EquilibriumJitter float64
+	// HedgeDelay, if set, starts a second, concurrent run of an attempt of
+	// the operation if the first one has not returned after HedgeDelay.
+	// The attempt succeeds as soon as either run succeeds, and the other run
+	// is then canceled through the context passed by IfNecessaryCtx; it
+	// only fails if both runs fail.  The operation must be safe to run
+	// concurrently.
+	HedgeDelay time.Duration
+	// RecoverPanics makes an attempt of the operation which panics fail with
+	// a *PanicError holding the value passed to panic and the stack trace,
+	// instead of crashing the process.  The retry loop returns that error,
+	// because a panic is not retryable unless RetryablePredicate decides
+	// otherwise.
+	RecoverPanics bool
+	// Clock, if set, replaces the real time for measuring the elapsed time
+	// and sleeping between attempts, so that tests can simulate the delays
+	// without waiting; see the retrytest package.
+	Clock Clock
+	// Rand, if set, makes the randomized delays and log sampling
+	// reproducible: every retry loop draws the seed of its own source from
+	// it, under a lock, so it can be shared by concurrent retry loops.  If
+	// it is not set, the package-level source of math/rand is used.
+	Rand *rand.Rand
+
+	sleepers   *semaphore.Weighted // Enforces RetryerOptions.ConcurrencyLimit, set by NewRetryer.
+	progressed func() bool         // Reports whether the last attempt made progress, set by Resumable.
+	deadline   time.Time           // Acts like a deadline of the context, set by Until.
+	unlimited  bool                // Retries until the context is done, set by WaitForReady.
+	window     *retryWindow        // Enforces RetryerOptions.RetryWindowLimit, set by NewRetryer.
+}
+
+// Logger is the subset of logrus.FieldLogger used to report retries, so that
+// a *logrus.Logger, a *logrus.Entry or an adapter to another logging library
+// can be used.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
 }
 
+// StructuredLogger is the subset of the *slog.Logger of the log/slog package
+// used to report retries as structured records, so that a *slog.Logger can be
+// used without this package depending on it.  args are alternating keys and
+// values, as for slog.
+type StructuredLogger interface {
+	InfoContext(ctx context.Context, msg string, args ...interface{})
+	WarnContext(ctx context.Context, msg string, args ...interface{})
+	ErrorContext(ctx context.Context, msg string, args ...interface{})
+}
+
+// discardLogger is a Logger ignoring all the messages, used if Silent is set.
+type discardLogger struct{}
+
+func (discardLogger) Infof(string, ...interface{})  {}
+func (discardLogger) Warnf(string, ...interface{})  {}
+func (discardLogger) Errorf(string, ...interface{}) {}
+
+// LogLevel is the level of an optional message of the retry loop.
+type LogLevel int
+
+const (
+	// LogNone does not log the message.
+	LogNone LogLevel = iota
+	// LogInfo logs the message with Infof.
+	LogInfo
+	// LogWarn logs the message with Warnf.
+	LogWarn
+	// LogError logs the message with Errorf.
+	LogError
+)
+
 // RetryOptions is deprecated, use Options.
 type RetryOptions = Options // nolint:revive
 
@@ -30,92 +322,695 @@ func RetryIfNecessary(ctx context.Context, operation func() error, options *Opti
 }
 
 // IfNecessary retries the operation in exponential backoff with the retry Options.
+// If options is nil, or neither MaxRetry nor MaxAttempts allow retries, the
+// operation is run once.
+// If ctx has a deadline that would expire during a backoff delay, the final
+// attempt is made immediately instead.
+//
+// When the operation does not succeed, the returned error is one of:
+//   - the error of the operation itself, if it is not retried, including on
+//     the first attempt;
+//   - an *Error wrapping the error of the last attempt, if the retries are
+//     exhausted after at least one retry, see IsExhausted;
+//   - an error wrapping the error of the last attempt, which also matches
+//     the cause of the cancellation of ctx with errors.Is, e.g.
+//     context.Canceled, if ctx is done before the retries are exhausted.
+//
+// IfNecessary does not allocate memory if the first attempt succeeds, unless
+// InitialDelay, SpreadStartup, JitterFirstAttemptOnly, AttemptTimeout,
+// HedgeDelay, RecoverPanics, StartAttempt or CircuitBreaker are set.
 func IfNecessary(ctx context.Context, operation func() error, options *Options) error {
+	if options != nil && (options.InitialDelay > 0 || options.SpreadStartup > 0 || options.JitterFirstAttemptOnly || options.AttemptTimeout > 0 || options.HedgeDelay > 0 || options.RecoverPanics || options.StartAttempt != nil || options.CircuitBreaker != nil) {
+		return IfNecessaryCtx(ctx, func(context.Context) error {
+			return operation()
+		}, options)
+	}
+	// Fast path: make the first attempt without any setup.
+	if options == nil {
+		options = &noOptions
+	}
+	start := options.getClock().Now()
+	if options.Budget != nil {
+		options.Budget.Deposit()
+	}
 	err := operation()
-	for attempt := 0; err != nil && isRetryable(err) && attempt < options.MaxRetry; attempt++ {
-		delay := time.Duration(int(math.Pow(2, float64(attempt)))) * time.Second
-		if options.Delay != 0 {
-			delay = options.Delay
+	if err == nil || (options.SuccessPredicate != nil && options.SuccessPredicate(err)) {
+		options.metrics().ObserveAttempts(1)
+		return nil
+	}
+	_, err = retryFailed(ctx, func(context.Context) error {
+		return operation()
+	}, options, nil, start, options.getClock().Since(start), false, err)
+	return err
+}
+
+// Retry retries the operation like IfNecessary, for callers which cannot
+// cancel it.
+func Retry(operation func() error, options *Options) error {
+	return IfNecessary(context.Background(), operation, options)
+}
+
+// ErrStopped is matched by the error returned by IfNecessaryWithStop when the
+// stop channel is closed before the operation succeeds.
+var ErrStopped = errors.New("stopped")
+
+// IfNecessaryWithStop retries the operation like IfNecessary, for callers
+// which cancel it by closing stop instead of with a context.  If stop is
+// closed while waiting for a retry, the error of the last attempt is
+// returned, wrapped so that errors.Is also matches ErrStopped.
+func IfNecessaryWithStop(operation func() error, stop <-chan struct{}, options *Options) error {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go func() {
+		select {
+		case <-stop:
+			cancel(ErrStopped)
+		case <-ctx.Done():
+		}
+	}()
+	return IfNecessary(ctx, operation, options)
+}
+
+// Until retries the operation like IfNecessary until it succeeds or deadline
+// passes, for callers with an absolute deadline, e.g. derived from an SLA.
+// Unless MaxRetry or MaxAttempts are set, only the deadline limits the
+// retries.  Like with a deadline of the context, a retry due after the
+// deadline is made immediately as the final attempt instead of sleeping past
+// it.
+func Until(deadline time.Time, operation func() error, options *Options) error {
+	untilOptions := Options{}
+	if options != nil {
+		untilOptions = *options
+	}
+	remaining := deadline.Sub(untilOptions.getClock().Now())
+	switch {
+	case remaining <= 0:
+		untilOptions.MaxAttempts = 1
+	case untilOptions.MaxElapsedTime == 0 || remaining < untilOptions.MaxElapsedTime:
+		untilOptions.MaxElapsedTime = remaining
+	}
+	untilOptions.deadline = deadline
+	return IfNecessary(context.Background(), operation, &untilOptions)
+}
+
+// onceDelay is the delay Once waits before its retry.
+const onceDelay = 100 * time.Millisecond
+
+// Once retries the operation like IfNecessary at most once, after a short
+// delay, if it fails with a retryable error.
+func Once(ctx context.Context, operation func() error) error {
+	return IfNecessary(ctx, operation, &Options{MaxRetry: 1, Delay: onceDelay})
+}
+
+// IfNecessaryFromFactory retries an operation like IfNecessary, calling
+// newOperation before every attempt to build a fresh operation, e.g. one
+// with a new reader or buffer, for operations which cannot be repeated once
+// they failed.
+func IfNecessaryFromFactory(ctx context.Context, newOperation func() func() error, options *Options) error {
+	return IfNecessary(ctx, func() error {
+		return newOperation()()
+	}, options)
+}
+
+// IfNecessaryWithFallback retries primary like IfNecessary, and if it is still
+// failing with a retryable error once the retries are exhausted, runs
+// fallback once, e.g. against a mirror, and returns its result.  If primary
+// fails with an error that is not retried, or ctx is done, that error is
+// returned without running fallback.
+func IfNecessaryWithFallback(ctx context.Context, primary func() error, fallback func() error, options *Options) error {
+	err := IfNecessary(ctx, primary, options)
+	if !IsExhausted(err) {
+		return err
+	}
+	if options == nil {
+		options = &Options{}
+	}
+	options.logger().Warnf("Failed after retrying, trying the fallback. Error: %v", err)
+	return fallback()
+}
+
+// IfNecessaryCtx is like IfNecessary, but passes a context derived from ctx
+// to every attempt of the operation, so that it can observe a cancellation
+// happening while it runs. That context is limited by AttemptTimeout if set.
+func IfNecessaryCtx(ctx context.Context, operation func(ctx context.Context) error, options *Options) error {
+	_, err := ifNecessary(ctx, operation, options)
+	return err
+}
+
+// IfNecessaryWithCount is like IfNecessary, but also returns the number of
+// attempts of the operation that were made, 1 if it succeeded right away.
+func IfNecessaryWithCount(ctx context.Context, operation func() error, options *Options) (int, error) {
+	return ifNecessary(ctx, func(context.Context) error {
+		return operation()
+	}, options)
+}
+
+// ErrRetryRequested is the error of an attempt made by If which requested a
+// retry without failing.  If the retries are exhausted this way, If returns
+// an *Error wrapping it.
+var ErrRetryRequested = errors.New("operation requested a retry")
+
+// If is like IfNecessary, but the operation itself decides whether it is
+// retried: it is retried, while retries remain, if it returns true, and the
+// loop ends immediately if it returns false, whether err is retryable or not.
+// If it returns true and a nil err, the attempt fails with ErrRetryRequested.
+// DoNotRetryOn still applies.
+func If(ctx context.Context, operation func() (retry bool, err error), options *Options) error {
+	return IfNecessary(ctx, func() error {
+		retry, err := operation()
+		switch {
+		case !retry:
+			return Permanent(err)
+		case err == nil:
+			return Retryable(ErrRetryRequested)
+		default:
+			return Retryable(err)
+		}
+	}, options)
+}
+
+// noOptions are the Options used if none are provided.  They must not be modified.
+var noOptions Options
+
+// ifNecessary implements IfNecessaryCtx, and returns the number of attempts made.
+func ifNecessary(ctx context.Context, operation func(ctx context.Context) error, options *Options) (int, error) {
+	if options == nil {
+		options = &noOptions
+	}
+	var rng *rand.Rand
+	clock := options.getClock()
+	start := clock.Now()
+	if options.InitialDelay > 0 || options.SpreadStartup > 0 || options.JitterFirstAttemptOnly {
+		delay := options.InitialDelay
+		if options.JitterFirstAttemptOnly && delay == 0 {
+			delay = options.baseDelay()
+		}
+		if options.Jitter || options.JitterFirstAttemptOnly {
+			rng = options.newRand()
+			delay = jitter(delay, rng)
+		}
+		if options.SpreadStartup > 0 {
+			if rng == nil {
+				rng = options.newRand()
+			}
+			delay += jitter(options.SpreadStartup, rng)
 		}
-		logrus.Warnf("Failed, retrying in %s ... (%d/%d). Error: %v", delay, attempt+1, options.MaxRetry, err)
 		select {
-		case <-time.After(delay):
+		case <-clock.After(delay):
+		case <-ctx.Done():
+			options.metrics().ObserveAttempts(0)
+			return 0, context.Cause(ctx)
+		}
+	}
+	if options.Budget != nil {
+		options.Budget.Deposit()
+	}
+	attemptStart := clock.Now()
+	timedOut, err := options.attempt(withAttempt(ctx, 1), operation)
+	return retryFailed(ctx, operation, options, rng, start, clock.Since(attemptStart), timedOut, err)
+}
+
+// retryFailed retries the operation after its first attempt, which ran for
+// execTime and returned err, possibly because its AttemptTimeout expired.
+// The retry loop started at start.  It returns the total number of attempts
+// made, and the final error.  rng is the random source used so far, if any.
+func retryFailed(ctx context.Context, operation func(ctx context.Context) error, options *Options, rng *rand.Rand, start time.Time, execTime time.Duration, timedOut bool, err error) (int, error) {
+	var (
+		errs      []error
+		prev      time.Duration
+		slept     time.Duration // The sum of the delays, as computed.
+		sleepTime time.Duration // The time actually spent waiting for them.
+		step      int           // The number of the retry for computing the backoff, reset by ResetOnProgress.
+		same      = 1           // The number of consecutive attempts which failed with err.
+		final     bool
+	)
+	clock := options.getClock()
+	metrics := options.metrics()
+	attempts := 1
+	attemptStart := clock.Now().Add(-execTime) // The start of the last attempt.
+	defer func() {
+		metrics.ObserveAttempts(attempts)
+	}()
+	// Every limit is checked before sleeping, so the loop never waits after
+	// the last attempt.
+	for attempt := 0; err != nil; attempt++ {
+		elapsed := clock.Since(start)
+		if final || options.exhausted(attempt, elapsed) {
+			break
+		}
+		// ShouldGiveUp vetoes any retry left, so it sees every failure
+		// before the error is classified.
+		if options.ShouldGiveUp != nil && options.ShouldGiveUp(err, attempts, elapsed) {
+			options.logger().Warnf("Failed, not retrying: giving up after %d attempts. Error: %v", attempts, err)
+			return attempts, options.failure(err, errs)
+		}
+		if !options.shouldRetry(err, timedOut) {
+			break
+		}
+		if options.MaxConsecutiveSameError > 0 && same >= options.MaxConsecutiveSameError {
+			options.logger().Warnf("Failed, not retrying: the last %d attempts failed with the same error. Error: %v", same, err)
+			return attempts, options.failure(err, errs)
+		}
+		if options.PreRetry != nil && !options.PreRetry(ctx, attempt+1, err) {
+			options.logger().Warnf("Failed, not retrying: stopped before retry %s. Error: %v", options.progress(attempt+1), err)
+			return attempts, options.failure(err, errs)
+		}
+		delay, ok := time.Duration(0), false
+		if options.RetryAfter != nil {
+			delay, ok = options.RetryAfter(err)
+		}
+		if !ok && options.DelayForError != nil {
+			delay, ok = options.DelayForError(err, attempt+1)
+		}
+		if rng == nil && options.randomized() {
+			rng = options.newRand()
+		}
+		if options.ResetOnProgress && options.progressed != nil && options.progressed() {
+			step, prev = 0, 0
+		}
+		if attempt < options.ImmediateAttempts {
+			if !ok {
+				delay = 0
+			}
+		} else {
+			if !ok {
+				delay = nextDelay(step, prev, options, rng)
+			}
+			step++
+		}
+		if options.MinInterval > 0 {
+			if wait := options.MinInterval - clock.Since(attemptStart); delay < wait {
+				delay = wait
+			}
+		}
+		if options.MaxTotalDelay > 0 && delay > options.MaxTotalDelay-slept {
+			break
+		}
+		// Only take a token from the budget and a slot in the window once no
+		// other limit stops the retry, so that retries given up do not count.
+		if options.Budget != nil && !options.Budget.Allow() {
+			options.logger().Warnf("Failed, not retrying: retry budget exhausted. Error: %v", err)
+			return attempts, options.failure(err, errs)
+		}
+		if options.window != nil && !options.window.allow() {
+			options.logger().Warnf("Failed, not retrying: retry window limit reached. Error: %v", err)
+			return attempts, options.failure(err, errs)
+		}
+		prev = delay
+		if deadline, ok := options.deadlineOf(ctx); ok && delay >= deadline.Sub(clock.Now()) {
+			// Sleeping until the deadline would leave no time for the next
+			// attempt; make the final attempt right away instead.
+			delay = 0
+			final = true
+		}
+		if options.LogSampleRate <= 1 || intn(options.LogSampleRate, rng) == 0 {
+			options.logRetry(ctx, attempt+1, delay, err)
+		}
+		if options.OnRetry != nil {
+			options.OnRetry(attempt+1, delay, err)
+		}
+		metrics.IncRetry(attempt + 1)
+		if options.sleepers != nil {
+			if options.sleepers.Acquire(ctx, 1) != nil {
+				return attempts, &abortedError{err: options.failure(err, errs), cause: context.Cause(ctx)}
+			}
+		}
+		sleepStart := clock.Now()
+		select {
+		case <-clock.After(delay):
 			break
 		case <-ctx.Done():
-			return err
+			if options.sleepers != nil {
+				options.sleepers.Release(1)
+			}
+			return attempts, &abortedError{err: options.failure(err, errs), cause: context.Cause(ctx)}
+		}
+		if options.sleepers != nil {
+			options.sleepers.Release(1)
+		}
+		sleepTime += clock.Since(sleepStart)
+		slept += delay
+		if options.Limiter != nil {
+			if waitErr := options.Limiter.Wait(ctx); waitErr != nil {
+				cause := context.Cause(ctx)
+				if _, ok := ctx.Deadline(); ok && cause == nil {
+					// The token would only be available after the deadline.
+					cause = context.DeadlineExceeded
+				} else if cause == nil {
+					cause = waitErr
+				}
+				return attempts, &abortedError{err: options.failure(err, errs), cause: cause}
+			}
+		}
+		if options.AggregateErrors {
+			errs = append(errs, err)
+		}
+		attempts++
+		lastErr := err
+		attemptStart = clock.Now()
+		timedOut, err = options.attempt(withAttempt(ctx, attempts), operation)
+		execTime += clock.Since(attemptStart)
+		if sameError(err, lastErr) {
+			same++
+		} else {
+			same = 1
 		}
-		err = operation()
 	}
-	return err
+	if final && options.shouldRetry(err, timedOut) {
+		// The deadline of ctx, not the options, prevented further retries.
+		return attempts, &abortedError{err: options.failure(err, errs), cause: context.DeadlineExceeded}
+	}
+	if options.shouldRetry(err, timedOut) && attempts > 1 {
+		metrics.IncExhausted()
+		exhausted := &Error{
+			Attempts:  attempts,
+			Elapsed:   clock.Since(start),
+			SleepTime: sleepTime,
+			ExecTime:  execTime,
+			LastDelay: prev,
+			LastErr:   options.failure(err, errs),
+		}
+		options.logExhausted(ctx, exhausted)
+		return attempts, exhausted
+	}
+	if err == nil && attempts > 1 && options.LogRecovered {
+		options.logRecovered(ctx, attempts-1, clock.Since(start))
+	}
+	return attempts, options.fatalFailure(err, errs)
 }
 
-func isRetryable(err error) bool {
-	switch err {
-	case nil:
+// sameError returns true if err and lastErr, the errors of two consecutive
+// attempts, report the same failure.
+func sameError(err, lastErr error) bool {
+	if err == nil || lastErr == nil {
 		return false
-	case context.Canceled, context.DeadlineExceeded:
+	}
+	return errors.Is(err, lastErr) || err.Error() == lastErr.Error()
+}
+
+// Validate returns an error if the options contain invalid values.  A nil
+// *Options is valid, and means the operation is not retried.
+func (o *Options) Validate() error {
+	if o == nil {
+		return nil
+	}
+	for _, field := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"Delay", o.Delay},
+		{"InitialDelay", o.InitialDelay},
+		{"SpreadStartup", o.SpreadStartup},
+		{"BaseDelay", o.BaseDelay},
+		{"MaxDelay", o.MaxDelay},
+		{"MaxJitter", o.MaxJitter},
+		{"AttemptTimeout", o.AttemptTimeout},
+		{"MaxElapsedTime", o.MaxElapsedTime},
+		{"MaxTotalDelay", o.MaxTotalDelay},
+		{"HedgeDelay", o.HedgeDelay},
+		{"MinInterval", o.MinInterval},
+	} {
+		if field.value < 0 {
+			return fmt.Errorf("invalid retry options: %s %s is negative", field.name, field.value)
+		}
+	}
+	if o.ImmediateAttempts < 0 {
+		return fmt.Errorf("invalid retry options: ImmediateAttempts %d is negative", o.ImmediateAttempts)
+	}
+	if o.AttemptOffset < 0 {
+		return fmt.Errorf("invalid retry options: AttemptOffset %d is negative", o.AttemptOffset)
+	}
+	if o.LogSampleRate < 0 {
+		return fmt.Errorf("invalid retry options: LogSampleRate %d is negative", o.LogSampleRate)
+	}
+	if o.MaxConsecutiveSameError < 0 {
+		return fmt.Errorf("invalid retry options: MaxConsecutiveSameError %d is negative", o.MaxConsecutiveSameError)
+	}
+	if o.MaxRetry < 0 {
+		return fmt.Errorf("invalid retry options: MaxRetry %d is negative", o.MaxRetry)
+	}
+	if o.MaxAttempts < 0 {
+		return fmt.Errorf("invalid retry options: MaxAttempts %d is negative", o.MaxAttempts)
+	}
+	if o.Factor != 0 && o.Factor < 1 {
+		return fmt.Errorf("invalid retry options: Factor %v is less than 1", o.Factor)
+	}
+	if o.RandomizationFactor < 0 || o.RandomizationFactor > 1 {
+		return fmt.Errorf("invalid retry options: RandomizationFactor %v is not within [0, 1]", o.RandomizationFactor)
+	}
+	if o.EquilibriumJitter < 0 || o.EquilibriumJitter > 1 {
+		return fmt.Errorf("invalid retry options: EquilibriumJitter %v is not within [0, 1]", o.EquilibriumJitter)
+	}
+	switch o.Strategy {
+	case BackoffExponential, BackoffFullJitter, BackoffDecorrelated, BackoffLinear, BackoffConstant, BackoffFibonacci:
+	default:
+		return fmt.Errorf("invalid retry options: unknown backoff strategy %d", o.Strategy)
+	}
+	return nil
+}
+
+// maxRetry returns the maximum number of retries set by MaxAttempts or
+// MaxRetry, and whether either is set.
+func (o *Options) maxRetry() (int, bool) {
+	if o.MaxAttempts > 0 {
+		return o.MaxAttempts - 1, true
+	}
+	return o.MaxRetry, o.MaxRetry > 0
+}
+
+// exhausted returns true if no retry is left after attempt retries and elapsed time.
+func (o *Options) exhausted(attempt int, elapsed time.Duration) bool {
+	if o.unlimited {
 		return false
-	default: // continue
 	}
+	maxRetry, limited := o.maxRetry()
+	if o.MaxElapsedTime > 0 {
+		return elapsed >= o.MaxElapsedTime || (limited && attempt >= maxRetry)
+	}
+	return attempt >= maxRetry
+}
+
+// deadlineOf returns the earliest of the deadline of ctx and the one set by
+// Until, if any.
+func (o *Options) deadlineOf(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Deadline()
+	if !o.deadline.IsZero() && (!ok || o.deadline.Before(deadline)) {
+		return o.deadline, true
+	}
+	return deadline, ok
+}
 
-	type unwrapper interface {
-		Unwrap() error
+// progress formats the number of the upcoming retry for log messages.
+func (o *Options) progress(retry int) string {
+	if o.unlimited {
+		return fmt.Sprintf("%d", retry)
+	}
+	maxRetry, limited := o.maxRetry()
+	if o.MaxElapsedTime > 0 && !limited {
+		return fmt.Sprintf("%d/%s", retry, o.MaxElapsedTime)
 	}
+	return fmt.Sprintf("%d/%d", retry, maxRetry)
+}
 
+// attemptKey is the context key of the number of the current attempt.
+type attemptKey struct{}
+
+// withAttempt returns a context derived from ctx for the attempt number n.
+func withAttempt(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, n)
+}
+
+// AttemptFromContext returns the 1-based number of the attempt of an
+// operation retried by IfNecessaryCtx, when called with the context passed to
+// that operation or one derived from it, e.g. to tag requests, logs or
+// metrics.  It returns 0 for other contexts.
+func AttemptFromContext(ctx context.Context) int {
+	n, _ := ctx.Value(attemptKey{}).(int)
+	return n
+}
+
+// attempt runs the operation once if the CircuitBreaker allows it, within
+// AttemptTimeout if set and between the StartAttempt hook and its finisher,
+// and reports whether it failed because that timeout expired.
+func (o *Options) attempt(ctx context.Context, operation func(ctx context.Context) error) (bool, error) {
+	if o.CircuitBreaker != nil && !o.CircuitBreaker.Allow() {
+		return false, Permanent(ErrCircuitOpen)
+	}
+	var finish func(err error)
+	if o.StartAttempt != nil {
+		ctx, finish = o.StartAttempt(ctx, AttemptFromContext(ctx))
+	}
+	timedOut, err := o.timedAttempt(ctx, operation)
+	if finish != nil {
+		finish(err)
+	}
+	if o.CircuitBreaker != nil {
+		if err != nil {
+			o.CircuitBreaker.RecordFailure()
+		} else {
+			o.CircuitBreaker.RecordSuccess()
+		}
+	}
+	return timedOut, err
+}
+
+// timedAttempt runs the operation once, within AttemptTimeout if set, and
+// reports whether it failed because that timeout expired.
+func (o *Options) timedAttempt(ctx context.Context, operation func(ctx context.Context) error) (bool, error) {
+	if o.AttemptTimeout <= 0 {
+		return false, o.run(ctx, operation)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, o.AttemptTimeout)
+	defer cancel()
+	err := o.run(attemptCtx, operation)
+	// Only the timeout itself is retried, not other errors returned after
+	// it expired, e.g. by an operation ignoring its context.
+	timedOut := errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded)
+	return timedOut, err
+}
+
+// failure returns the error a retry loop ending with err reports, given
+// the errors of the preceding attempts collected with AggregateErrors.
+func (o *Options) failure(err error, errs []error) error {
 	switch e := err.(type) {
+	case *permanentError:
+		err = e.err
+	case *retryableError:
+		err = e.err
+	}
+	if err == nil || !o.AggregateErrors {
+		return err
+	}
+	return &multierror.Error{Errors: append(errs, err)}
+}
 
-	case errcode.Error:
-		switch e.Code {
-		case errcode.ErrorCodeUnauthorized, errcode.ErrorCodeDenied,
-			errcodev2.ErrorCodeNameUnknown, errcodev2.ErrorCodeManifestUnknown:
-			return false
+// fatalFailure is like failure, for a retry loop ending because err is not
+// retryable: with AggregateErrors, err is tagged as a *FatalError.
+func (o *Options) fatalFailure(err error, errs []error) error {
+	err = o.failure(err, errs)
+	if merr, ok := err.(*multierror.Error); ok && o.AggregateErrors {
+		last := len(merr.Errors) - 1
+		merr.Errors[last] = &FatalError{Err: merr.Errors[last]}
+	}
+	return err
+}
+
+// IfNecessaryWithResult retries the operation like IfNecessary and returns the
+// result of the last attempt. On failure the zero value of T is returned
+// together with the final error.
+func IfNecessaryWithResult[T any](ctx context.Context, operation func() (T, error), options *Options) (T, error) {
+	var result T
+	err := IfNecessary(ctx, func() error {
+		var err error
+		result, err = operation()
+		return err
+	}, options)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+// IfNecessaryWithResult2 is like IfNecessaryWithResult, for operations
+// returning two values, e.g. a blob reader and its digest.
+func IfNecessaryWithResult2[A, B any](ctx context.Context, operation func() (A, B, error), options *Options) (A, B, error) {
+	type results struct {
+		a A
+		b B
+	}
+	r, err := IfNecessaryWithResult(ctx, func() (results, error) {
+		a, b, err := operation()
+		return results{a: a, b: b}, err
+	}, options)
+	return r.a, r.b, err
+}
+
+// IfNecessaryWithValidator is like IfNecessaryWithResult, but also passes the
+// result of every successful attempt to validator, e.g. to reject a result
+// that is incomplete because of eventual consistency.  An error returned by
+// validator is handled as if the attempt had failed with it, so it is
+// retried if it is retryable, e.g. if wrapped by Retryable.  See
+// ReturnLastResult for the result returned if ctx is done.
+func IfNecessaryWithValidator[T any](ctx context.Context, operation func() (T, error), validator func(T) error, options *Options) (T, error) {
+	var (
+		rejected    T
+		hasRejected bool
+	)
+	result, err := IfNecessaryWithResult(ctx, func() (T, error) {
+		result, err := operation()
+		if err != nil {
+			return result, err
 		}
-		return true
-	case *net.OpError:
-		return isRetryable(e.Err)
-	case *url.Error: // This includes errors returned by the net/http client.
-		if e.Err == io.EOF { // Happens when a server accepts a HTTP connection and sends EOF
-			return true
-		}
-		return isRetryable(e.Err)
-	case syscall.Errno:
-		return isErrnoRetryable(e)
-	case errcode.Errors:
-		// if this error is a group of errors, process them all in turn
-		for i := range e {
-			if !isRetryable(e[i]) {
-				return false
-			}
+		if err := validator(result); err != nil {
+			rejected, hasRejected = result, true
+			return result, err
 		}
-		return true
-	case *multierror.Error:
-		// if this error is a group of errors, process them all in turn
-		for i := range e.Errors {
-			if !isRetryable(e.Errors[i]) {
-				return false
-			}
+		return result, nil
+	}, options)
+	var aborted *abortedError
+	if err != nil && options != nil && options.ReturnLastResult && hasRejected && errors.As(err, &aborted) {
+		return rejected, err
+	}
+	return result, err
+}
+
+// logger returns the Logger to report retries to.
+func (o *Options) logger() Logger {
+	if o.Silent {
+		return discardLogger{}
+	}
+	if o.SlogLogger != nil {
+		return slogLogger{logger: o.SlogLogger}
+	}
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return logrus.StandardLogger()
+}
+
+// shouldRetry reports whether the attempt that failed with err, possibly
+// because its AttemptTimeout expired, should be retried.
+func (o *Options) shouldRetry(err error, timedOut bool) bool {
+	if err == nil {
+		return false
+	}
+	for _, target := range o.DoNotRetryOn {
+		if errors.Is(err, target) {
+			return false
 		}
+	}
+	var (
+		permanent *permanentError
+		retryable *retryableError
+	)
+	if errors.As(err, &permanent) {
+		return false
+	}
+	if !o.Idempotent && requestSent(err) {
+		return false
+	}
+	if errors.As(err, &retryable) {
 		return true
-	case net.Error:
-		if e.Timeout() {
-			return true
-		}
-		if unwrappable, ok := e.(unwrapper); ok {
-			err = unwrappable.Unwrap()
-			return isRetryable(err)
-		}
-	case unwrapper: // Test this last, because various error types might implement .Unwrap()
-		err = e.Unwrap()
-		return isRetryable(err)
 	}
-
-	return false
+	return timedOut || o.isRetryable(err)
 }
 
-func isErrnoRetryable(e error) bool {
-	switch e {
-	case syscall.ECONNREFUSED, syscall.EINTR, syscall.EAGAIN, syscall.EBUSY, syscall.ENETDOWN, syscall.ENETUNREACH, syscall.ENETRESET, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.EHOSTDOWN, syscall.EHOSTUNREACH:
+// isRetryable reports whether err should be retried according to the options.
+func (o *Options) isRetryable(err error) bool {
+	if len(o.RetryOn) > 0 {
+		for _, target := range o.RetryOn {
+			if errors.Is(err, target) {
+				return true
+			}
+		}
+		return false
+	}
+	if o.RetryablePredicate != nil {
+		return o.RetryablePredicate(err)
+	}
+	if o.Idempotent && isRequestTimeout(err) {
 		return true
 	}
-	return isErrnoERESTART(e)
+	return classify(err, o.RetryableCodes, o.AnyRetryable)
 }
@@ -0,0 +1,1445 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/retry/internal/fakeclock"
+	"github.com/hashicorp/go-multierror"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func TestIfNecessaryWithResult(t *testing.T) {
+	options := &Options{MaxRetry: 3, Delay: time.Millisecond}
+
+	calls := 0
+	result, err := IfNecessaryWithResult(context.Background(), func() (string, error) {
+		calls++
+		if calls < 3 {
+			return "partial", syscall.ECONNRESET
+		}
+		return "done", nil
+	}, options)
+	require.NoError(t, err)
+	require.Equal(t, "done", result)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	failure := errors.New("not retryable")
+	result, err = IfNecessaryWithResult(context.Background(), func() (string, error) {
+		calls++
+		return "partial", failure
+	}, options)
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, "", result)
+	require.Equal(t, 1, calls)
+}
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := Retry(func() error {
+		calls++
+		if calls < 3 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = Retry(func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, Clock: newFakeClock()})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, 2, calls)
+}
+
+func TestOnce(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	err := Once(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	require.True(t, IsExhausted(err))
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 2, calls)
+	require.GreaterOrEqual(t, time.Since(start), onceDelay)
+
+	calls = 0
+	err = Once(context.Background(), func() error {
+		calls++
+		return syscall.EPERM
+	})
+	require.Equal(t, syscall.EPERM, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestIfNecessaryWithStop(t *testing.T) {
+	stop := make(chan struct{})
+	calls := 0
+	start := time.Now()
+	err := IfNecessaryWithStop(func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, stop, &Options{
+		MaxRetry: 3,
+		Delay:    time.Hour,
+		OnRetry: func(int, time.Duration, error) {
+			// Stop during the backoff.
+			time.AfterFunc(10*time.Millisecond, func() { close(stop) })
+		},
+	})
+	require.Equal(t, 1, calls)
+	require.ErrorIs(t, err, ErrStopped)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.False(t, IsExhausted(err))
+	require.Less(t, time.Since(start), time.Minute)
+
+	// The stop channel does not affect an operation which ends.
+	calls = 0
+	err = IfNecessaryWithStop(func() error {
+		calls++
+		if calls < 2 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, make(chan struct{}), &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+}
+
+func TestUntil(t *testing.T) {
+	// After 1s + 2s + 4s, sleeping 8s more would pass the deadline.
+	clock := newFakeClock()
+	deadline := clock.Now().Add(10 * time.Second)
+	calls := 0
+	err := Until(deadline, func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{BaseDelay: time.Second, Clock: clock})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 5, calls)
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 0}, clock.Slept())
+	require.False(t, clock.Now().After(deadline))
+
+	// MaxRetry still applies.
+	clock = newFakeClock()
+	calls = 0
+	err = Until(clock.Now().Add(time.Hour), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 2, Clock: clock})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, 3, calls)
+
+	// So does the classification.
+	calls = 0
+	err = Until(clock.Now().Add(time.Hour), func() error {
+		calls++
+		if calls < 3 {
+			return syscall.ECONNRESET
+		}
+		return syscall.EPERM
+	}, &Options{Clock: clock})
+	require.Equal(t, syscall.EPERM, err)
+	require.Equal(t, 3, calls)
+
+	// A deadline which passed allows a single attempt.
+	calls = 0
+	err = Until(clock.Now().Add(-time.Second), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Clock: clock})
+	require.Equal(t, syscall.ECONNRESET, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestIfNecessaryWithResult2(t *testing.T) {
+	options := &Options{MaxRetry: 3, Clock: newFakeClock()}
+
+	calls := 0
+	digest, size, err := IfNecessaryWithResult2(context.Background(), func() (string, int, error) {
+		calls++
+		if calls < 3 {
+			return "sha256:partial", 1, syscall.ECONNRESET
+		}
+		return "sha256:done", 42, nil
+	}, options)
+	require.NoError(t, err)
+	require.Equal(t, "sha256:done", digest)
+	require.Equal(t, 42, size)
+	require.Equal(t, 3, calls)
+
+	failure := errors.New("not retryable")
+	digest, size, err = IfNecessaryWithResult2(context.Background(), func() (string, int, error) {
+		return "sha256:partial", 1, failure
+	}, options)
+	require.ErrorIs(t, err, failure)
+	require.Equal(t, "", digest)
+	require.Equal(t, 0, size)
+}
+
+func TestIfNecessaryWithValidator(t *testing.T) {
+	errEmpty := errors.New("empty manifest list")
+	validator := func(instances []string) error {
+		if len(instances) == 0 {
+			return Retryable(errEmpty)
+		}
+		return nil
+	}
+	calls := 0
+	result, err := IfNecessaryWithValidator(context.Background(), func() ([]string, error) {
+		calls++
+		if calls < 3 {
+			return []string{}, nil
+		}
+		return []string{"amd64"}, nil
+	}, validator, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, []string{"amd64"}, result)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	result, err = IfNecessaryWithValidator(context.Background(), func() ([]string, error) {
+		calls++
+		return nil, nil
+	}, validator, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.ErrorIs(t, err, errEmpty)
+	require.Nil(t, result)
+	require.Equal(t, 3, calls)
+
+	// Validation errors are classified like other errors.
+	calls = 0
+	_, err = IfNecessaryWithValidator(context.Background(), func() ([]string, error) {
+		calls++
+		return nil, nil
+	}, func([]string) error { return errEmpty }, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.Equal(t, errEmpty, err)
+	require.Equal(t, 1, calls)
+}
+
+func TestReturnLastResult(t *testing.T) {
+	errIncomplete := errors.New("incomplete manifest list")
+	validator := func(instances []string) error {
+		if len(instances) < 2 {
+			return Retryable(errIncomplete)
+		}
+		return nil
+	}
+	for _, returnLastResult := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		result, err := IfNecessaryWithValidator(ctx, func() ([]string, error) {
+			calls++
+			switch calls {
+			case 1:
+				return []string{"amd64"}, nil
+			case 2:
+				return []string{"arm64"}, nil
+			}
+			return nil, syscall.ECONNRESET
+		}, validator, &Options{
+			MaxRetry:         10,
+			Delay:            time.Millisecond,
+			ReturnLastResult: returnLastResult,
+			// Cancel ctx while waiting for the 4th retry.
+			DelayForError: func(_ error, attempt int) (time.Duration, bool) {
+				return time.Hour, attempt == 4
+			},
+			OnRetry: func(attempt int, _ time.Duration, _ error) {
+				if attempt == 4 {
+					cancel()
+				}
+			},
+		})
+		cancel()
+		require.ErrorIs(t, err, context.Canceled)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		if returnLastResult {
+			require.Equal(t, []string{"arm64"}, result)
+		} else {
+			require.Nil(t, result)
+		}
+	}
+
+	// Only the cancellation returns the last result.
+	result, err := IfNecessaryWithValidator(context.Background(), func() ([]string, error) {
+		return []string{"amd64"}, nil
+	}, validator, &Options{MaxRetry: 2, ReturnLastResult: true, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.Nil(t, result)
+}
+
+func TestIfNecessaryFromFactory(t *testing.T) {
+	var readers []*bytes.Reader
+	err := IfNecessaryFromFactory(context.Background(), func() func() error {
+		reader := bytes.NewReader([]byte("manifest"))
+		readers = append(readers, reader)
+		return func() error {
+			// Consume part of the reader before failing.
+			if _, err := reader.Read(make([]byte, 4)); err != nil {
+				return err
+			}
+			if len(readers) < 3 {
+				return syscall.ECONNRESET
+			}
+			return nil
+		}
+	}, &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Len(t, readers, 3)
+	for _, reader := range readers {
+		// Every attempt got its own reader.
+		require.Equal(t, 4, reader.Len())
+	}
+}
+
+func TestIfNecessaryWithFallback(t *testing.T) {
+	primaryCalls, fallbackCalls := 0, 0
+	err := IfNecessaryWithFallback(context.Background(), func() error {
+		primaryCalls++
+		return syscall.ECONNREFUSED
+	}, func() error {
+		fallbackCalls++
+		return nil
+	}, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, 3, primaryCalls)
+	require.Equal(t, 1, fallbackCalls)
+
+	// The fallback is not used for errors that are not retried.
+	primaryCalls, fallbackCalls = 0, 0
+	err = IfNecessaryWithFallback(context.Background(), func() error {
+		primaryCalls++
+		return syscall.EPERM
+	}, func() error {
+		fallbackCalls++
+		return nil
+	}, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.Equal(t, syscall.EPERM, err)
+	require.Equal(t, 1, primaryCalls)
+	require.Equal(t, 0, fallbackCalls)
+
+	failure := errors.New("mirror failed")
+	err = IfNecessaryWithFallback(context.Background(), func() error {
+		return syscall.ECONNREFUSED
+	}, func() error {
+		return failure
+	}, &Options{MaxRetry: 1, Clock: newFakeClock()})
+	require.Equal(t, failure, err)
+
+	// Nor if no retry was permitted.
+	fallbackCalls = 0
+	err = IfNecessaryWithFallback(context.Background(), func() error {
+		return syscall.ECONNREFUSED
+	}, func() error {
+		fallbackCalls++
+		return nil
+	}, nil)
+	require.Equal(t, syscall.ECONNREFUSED, err)
+	require.Equal(t, 0, fallbackCalls)
+}
+
+func TestRetryablePredicate(t *testing.T) {
+	unauthorized := errors.New("unauthorized")
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		if calls < 2 {
+			return unauthorized
+		}
+		return nil
+	}, &Options{
+		MaxRetry:           2,
+		Delay:              time.Millisecond,
+		RetryablePredicate: func(err error) bool { return errors.Is(err, unauthorized) },
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	// The predicate replaces the default classification entirely.
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry:           2,
+		Delay:              time.Millisecond,
+		RetryablePredicate: func(err error) bool { return false },
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 1, calls)
+}
+
+func TestOnRetry(t *testing.T) {
+	var attempts []int
+	var delays []time.Duration
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry: 3,
+		Delay:    time.Millisecond,
+		OnRetry: func(attempt int, delay time.Duration, err error) {
+			require.ErrorIs(t, err, syscall.ECONNRESET)
+			attempts = append(attempts, attempt)
+			delays = append(delays, delay)
+		},
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, []int{1, 2, 3}, attempts)
+	require.Equal(t, []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}, delays)
+}
+
+func TestPreRetry(t *testing.T) {
+	calls := 0
+	var attempts []int
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry: 3,
+		Delay:    time.Millisecond,
+		PreRetry: func(_ context.Context, attempt int, err error) bool {
+			require.ErrorIs(t, err, syscall.ECONNRESET)
+			attempts = append(attempts, attempt)
+			return true
+		},
+	})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, 4, calls)
+	require.Equal(t, []int{1, 2, 3}, attempts)
+
+	calls = 0
+	retried := false
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry: 3,
+		Delay:    time.Millisecond,
+		PreRetry: func(_ context.Context, attempt int, _ error) bool {
+			return attempt < 2
+		},
+		OnRetry: func(attempt int, _ time.Duration, _ error) {
+			retried = retried || attempt == 2
+		},
+	})
+	require.Equal(t, syscall.ECONNRESET, err)
+	require.Equal(t, 2, calls)
+	require.False(t, retried)
+}
+
+func TestShouldGiveUp(t *testing.T) {
+	isServerError := func(err error) bool {
+		var statusErr StatusCoder
+		return errors.As(err, &statusErr) && statusErr.StatusCode() >= 500
+	}
+	giveUp := func(err error, attempt int, elapsed time.Duration) bool {
+		return elapsed > 2*time.Second && isServerError(err) && attempt > 2
+	}
+	for _, tc := range []struct {
+		err   error
+		calls int
+	}{
+		// Gives up after the third attempt, 3 seconds in.
+		{Retryable(statusError(503)), 3},
+		// Other errors are retried as usual.
+		{syscall.ECONNRESET, 6},
+		{Retryable(statusError(429)), 6},
+	} {
+		calls := 0
+		var seen []int
+		err := IfNecessary(context.Background(), func() error {
+			calls++
+			return tc.err
+		}, &Options{
+			MaxRetry: 5,
+			Delay:    1500 * time.Millisecond,
+			ShouldGiveUp: func(err error, attempt int, elapsed time.Duration) bool {
+				seen = append(seen, attempt)
+				return giveUp(err, attempt, elapsed)
+			},
+			Clock: newFakeClock(),
+		})
+		require.Error(t, err)
+		require.Equal(t, tc.calls, calls, "%v", tc.err)
+		if tc.calls == 3 {
+			require.False(t, IsExhausted(err))
+			require.Equal(t, statusError(503), err)
+			require.Equal(t, []int{1, 2, 3}, seen)
+		} else {
+			require.True(t, IsExhausted(err))
+			require.Equal(t, []int{1, 2, 3, 4, 5}, seen)
+		}
+	}
+
+	// It is not called once no retry is left, so that the retries are
+	// still reported as exhausted.
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 2, ShouldGiveUp: func(_ error, attempt int, _ time.Duration) bool {
+		return attempt >= 3
+	}, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, 3, calls)
+
+	// It is called for errors which are not retried too, before they are
+	// classified, but not on success.
+	var seen []error
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return syscall.EPERM
+		}
+		return nil
+	}, &Options{MaxRetry: 3, ShouldGiveUp: func(err error, _ int, _ time.Duration) bool {
+		seen = append(seen, err)
+		return false
+	}, Clock: newFakeClock()})
+	require.Equal(t, syscall.EPERM, err)
+	require.Equal(t, []error{syscall.EPERM}, seen)
+
+	seen, calls = nil, 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, &Options{MaxRetry: 3, ShouldGiveUp: func(err error, _ int, _ time.Duration) bool {
+		seen = append(seen, err)
+		return false
+	}, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, []error{syscall.ECONNRESET}, seen)
+
+	// Its veto applies whatever the classification.
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return Retryable(syscall.EPERM)
+	}, &Options{MaxRetry: 3, ShouldGiveUp: func(error, int, time.Duration) bool {
+		return true
+	}, Clock: newFakeClock()})
+	require.ErrorIs(t, err, syscall.EPERM)
+	require.Equal(t, 1, calls)
+}
+
+func TestStartAttempt(t *testing.T) {
+	type spanKey struct{}
+	var (
+		started []int
+		ended   []error
+	)
+	calls := 0
+	err := IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		calls++
+		// The operation is given the context of its span.
+		require.Equal(t, calls, ctx.Value(spanKey{}))
+		require.Equal(t, calls, AttemptFromContext(ctx))
+		if calls < 3 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, &Options{
+		MaxRetry: 3,
+		StartAttempt: func(ctx context.Context, attempt int) (context.Context, func(err error)) {
+			started = append(started, attempt)
+			return context.WithValue(ctx, spanKey{}, attempt), func(err error) {
+				ended = append(ended, err)
+			}
+		},
+		Clock: newFakeClock(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, started)
+	require.Equal(t, []error{syscall.ECONNRESET, syscall.ECONNRESET, nil}, ended)
+
+	// The fast path of IfNecessary calls it too, and the finisher is optional.
+	started = nil
+	err = IfNecessary(context.Background(), func() error { return nil }, &Options{
+		StartAttempt: func(ctx context.Context, attempt int) (context.Context, func(err error)) {
+			started = append(started, attempt)
+			return ctx, nil
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, started)
+}
+
+func TestLimiter(t *testing.T) {
+	calls := 0
+	start := time.Now()
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry: 3,
+		Delay:    time.Millisecond,
+		Limiter:  rate.NewLimiter(rate.Every(50*time.Millisecond), 1),
+	})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, 4, calls)
+	// The first retry takes the initial token, the others wait for one each.
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	calls = 0
+	err = IfNecessary(ctx, func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry: 3,
+		Delay:    time.Millisecond,
+		Limiter:  rate.NewLimiter(rate.Every(time.Hour), 1),
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.False(t, IsExhausted(err))
+	require.Equal(t, 2, calls)
+}
+
+func TestOnRetryActualDelay(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	clock := fakeclock.New(time.Now())
+	var delays []time.Duration
+	err := IfNecessary(ctx, func() error {
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry:  100,
+		BaseDelay: 10 * time.Second,
+		MaxDelay:  time.Minute,
+		Jitter:    true,
+		OnRetry: func(_ int, delay time.Duration, _ error) {
+			delays = append(delays, delay)
+		},
+		Rand:  rand.New(rand.NewSource(1)),
+		Clock: clock,
+	})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, clock.Slept(), delays)
+	// The delays were randomized, and the last one shortened to the deadline.
+	require.NotEqual(t, (&Options{MaxRetry: len(delays), BaseDelay: 10 * time.Second, MaxDelay: time.Minute}).DelaySchedule(), delays)
+	require.Equal(t, time.Duration(0), delays[len(delays)-1])
+}
+
+func TestAggregateErrors(t *testing.T) {
+	failures := []error{syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.ECONNREFUSED}
+	calls := 0
+	operation := func() error {
+		err := failures[calls]
+		calls++
+		return err
+	}
+
+	err := IfNecessary(context.Background(), operation, &Options{MaxRetry: 2, Delay: time.Millisecond})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, syscall.ECONNREFUSED, retryErr.LastErr)
+
+	calls = 0
+	err = IfNecessary(context.Background(), operation, &Options{MaxRetry: 2, Delay: time.Millisecond, AggregateErrors: true})
+	var merr *multierror.Error
+	require.ErrorAs(t, err, &merr)
+	require.Equal(t, failures, merr.Errors)
+	for _, failure := range failures {
+		require.ErrorIs(t, err, failure)
+	}
+	var fatal *FatalError
+	require.False(t, errors.As(err, &fatal))
+
+	// The error which stopped the loop is tagged.
+	failures = []error{syscall.ECONNRESET, syscall.ETIMEDOUT, Permanent(syscall.EPERM)}
+	calls = 0
+	err = IfNecessary(context.Background(), operation, &Options{MaxRetry: 5, Delay: time.Millisecond, AggregateErrors: true})
+	require.ErrorAs(t, err, &merr)
+	require.Equal(t, []error{syscall.ECONNRESET, syscall.ETIMEDOUT, &FatalError{Err: syscall.EPERM}}, merr.Errors)
+	require.ErrorAs(t, err, &fatal)
+	require.Equal(t, syscall.EPERM, fatal.Err)
+	require.ErrorIs(t, err, syscall.EPERM)
+	require.Equal(t, syscall.EPERM.Error(), fatal.Error())
+}
+
+func TestRetryAfter(t *testing.T) {
+	tooManyRequests := errors.New("429 too many requests")
+	var delays []time.Duration
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return tooManyRequests
+		}
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry:           2,
+		Delay:              time.Millisecond,
+		RetryablePredicate: func(error) bool { return true },
+		RetryAfter: func(err error) (time.Duration, bool) {
+			if errors.Is(err, tooManyRequests) {
+				return 2 * time.Millisecond, true
+			}
+			return 0, false
+		},
+		OnRetry: func(_ int, delay time.Duration, _ error) {
+			delays = append(delays, delay)
+		},
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, []time.Duration{2 * time.Millisecond, time.Millisecond}, delays)
+}
+
+func TestDelayForError(t *testing.T) {
+	tooManyRequests := errors.New("429 too many requests")
+	failures := []error{tooManyRequests, syscall.ECONNRESET, io.ErrUnexpectedEOF, tooManyRequests, syscall.ECONNRESET}
+	var delays []time.Duration
+	var retries []int
+	calls := 0
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		err := failures[calls]
+		calls++
+		return err
+	}, &Options{
+		MaxRetry:           len(failures) - 1,
+		BaseDelay:          time.Second,
+		MaxDelay:           10 * time.Second,
+		RetryablePredicate: func(error) bool { return true },
+		RetryAfter: func(err error) (time.Duration, bool) {
+			if errors.Is(err, tooManyRequests) && calls == 1 {
+				return time.Minute, true
+			}
+			return 0, false
+		},
+		DelayForError: func(err error, attempt int) (time.Duration, bool) {
+			retries = append(retries, attempt)
+			switch {
+			case errors.Is(err, tooManyRequests):
+				return 30 * time.Second, true
+			case errors.Is(err, syscall.ECONNRESET):
+				return 100 * time.Millisecond, true
+			}
+			return 0, false
+		},
+		OnRetry: func(_ int, delay time.Duration, _ error) {
+			delays = append(delays, delay)
+		},
+		Clock: clock,
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.True(t, IsExhausted(err))
+	// RetryAfter takes precedence, DelayForError is not capped to MaxDelay,
+	// and other errors get the exponential backoff of their retry number.
+	require.Equal(t, []int{2, 3, 4}, retries)
+	require.Equal(t, []time.Duration{time.Minute, 100 * time.Millisecond, 4 * time.Second, 30 * time.Second}, delays)
+	require.Equal(t, delays, clock.Slept())
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	calls := 0
+	err := IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			// Hang until the per-attempt timeout expires.
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}, &Options{MaxRetry: 3, Delay: time.Millisecond, AttemptTimeout: 10 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// Expiration of the parent context is not retried.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	calls = 0
+	err = IfNecessaryCtx(ctx, func(ctx context.Context) error {
+		calls++
+		<-ctx.Done()
+		return ctx.Err()
+	}, &Options{MaxRetry: 3, Delay: time.Millisecond, AttemptTimeout: time.Minute})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 1, calls)
+
+	// Neither is an error returned after the timeout expired, if it is not
+	// retryable itself.
+	calls = 0
+	err = IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		calls++
+		time.Sleep(30 * time.Millisecond)
+		return syscall.EPERM
+	}, &Options{MaxRetry: 3, Delay: time.Millisecond, AttemptTimeout: 10 * time.Millisecond})
+	require.ErrorIs(t, err, syscall.EPERM)
+	require.Equal(t, 1, calls)
+}
+
+func TestAttemptFromContext(t *testing.T) {
+	require.Equal(t, 0, AttemptFromContext(context.Background()))
+
+	var seen []int
+	err := IfNecessaryCtx(context.Background(), func(ctx context.Context) error {
+		seen = append(seen, AttemptFromContext(ctx))
+		if len(seen) < 3 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, &Options{MaxRetry: 3, AttemptTimeout: time.Minute, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, seen)
+}
+
+func TestIfNecessaryCtxCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := IfNecessaryCtx(ctx, func(ctx context.Context) error {
+		calls++
+		// The cancellation must reach the operation while it is running.
+		cancel()
+		<-ctx.Done()
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Delay: time.Millisecond})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 1, calls)
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var delays []time.Duration
+	calls := 0
+	start := time.Now()
+	err := IfNecessary(ctx, func() error {
+		calls++
+		if calls < 2 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, &Options{
+		MaxRetry: 3,
+		Delay:    time.Minute,
+		OnRetry: func(_ int, delay time.Duration, _ error) {
+			delays = append(delays, delay)
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+	require.Equal(t, []time.Duration{0}, delays)
+	require.Less(t, time.Since(start), time.Second)
+
+	// Only a single immediate attempt is made at the edge of the deadline.
+	calls = 0
+	err = IfNecessary(ctx, func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Delay: time.Minute})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 2, calls)
+}
+
+func TestLogger(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, Delay: time.Millisecond, Logger: logger.WithField("request", "42")})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Len(t, hook.AllEntries(), 1)
+	entry := hook.LastEntry()
+	require.Equal(t, logrus.WarnLevel, entry.Level)
+	require.Equal(t, "42", entry.Data["request"])
+	require.Contains(t, entry.Message, "retrying in 1ms ... (1/1)")
+}
+
+func TestLogExhaustedAndRecovered(t *testing.T) {
+	for _, tc := range []struct {
+		level LogLevel
+		entry logrus.Level
+	}{
+		{LogInfo, logrus.InfoLevel},
+		{LogWarn, logrus.WarnLevel},
+		{LogError, logrus.ErrorLevel},
+	} {
+		logger, hook := test.NewNullLogger()
+		err := IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, &Options{MaxRetry: 2, ExhaustedLogLevel: tc.level, Logger: logger, Clock: newFakeClock()})
+		require.True(t, IsExhausted(err))
+		require.Len(t, hook.AllEntries(), 3)
+		entry := hook.LastEntry()
+		require.Equal(t, tc.entry, entry.Level)
+		require.Equal(t, "Failed, giving up after 3 attempts in 3s. Error: connection reset by peer", entry.Message)
+	}
+
+	calls := 0
+	operation := func() error {
+		calls++
+		if calls%3 != 0 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}
+	logger, hook := test.NewNullLogger()
+	err := IfNecessary(context.Background(), operation, &Options{MaxRetry: 2, ExhaustedLogLevel: LogError, LogRecovered: true, Logger: logger, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Len(t, hook.AllEntries(), 3)
+	entry := hook.LastEntry()
+	require.Equal(t, logrus.InfoLevel, entry.Level)
+	require.Equal(t, "Succeeded, recovered after 2 retries in 3s", entry.Message)
+
+	// Neither is logged by default.
+	hook.Reset()
+	require.NoError(t, IfNecessary(context.Background(), operation, &Options{MaxRetry: 2, Logger: logger, Clock: newFakeClock()}))
+	require.Len(t, hook.AllEntries(), 2)
+	hook.Reset()
+	err = IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 2, Logger: logger, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.Len(t, hook.AllEntries(), 2)
+}
+
+func TestSilent(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	slogLogger := &recordingLogger{}
+	var retries []int
+	for _, options := range []*Options{
+		{Logger: logger},
+		{SlogLogger: slogLogger},
+		{},
+	} {
+		options.MaxRetry = 2
+		options.Silent = true
+		options.ExhaustedLogLevel = LogError
+		options.LogRecovered = true
+		options.OnRetry = func(attempt int, _ time.Duration, _ error) { retries = append(retries, attempt) }
+		options.Clock = newFakeClock()
+		err := IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, options)
+		require.True(t, IsExhausted(err))
+		calls := 0
+		err = IfNecessary(context.Background(), func() error {
+			calls++
+			if calls == 1 {
+				return syscall.ECONNRESET
+			}
+			return nil
+		}, options)
+		require.NoError(t, err)
+	}
+	require.Empty(t, hook.AllEntries())
+	require.Empty(t, slogLogger.records)
+	// OnRetry is still called.
+	require.Equal(t, []int{1, 2, 1, 1, 2, 1, 1, 2, 1}, retries)
+}
+
+func TestLogSampleRate(t *testing.T) {
+	logged := func(rate int, seed int64) int {
+		logger, hook := test.NewNullLogger()
+		err := IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, &Options{MaxRetry: 1000, Delay: time.Millisecond, Logger: logger, LogSampleRate: rate, Rand: rand.New(rand.NewSource(seed)), Clock: newFakeClock()})
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		return len(hook.AllEntries())
+	}
+	require.Equal(t, 1000, logged(0, 1))
+	require.Equal(t, 1000, logged(1, 1))
+	sampled := logged(10, 1)
+	require.Greater(t, sampled, 50)
+	require.Less(t, sampled, 200)
+	// The sample is deterministic for a given random source.
+	require.Equal(t, sampled, logged(10, 1))
+}
+
+func TestIfNecessaryWithCount(t *testing.T) {
+	options := &Options{MaxRetry: 3, Delay: time.Millisecond}
+
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error { return nil }, options)
+	require.NoError(t, err)
+	require.Equal(t, 1, attempts)
+
+	attempts, err = IfNecessaryWithCount(context.Background(), func() error { return syscall.ECONNRESET }, options)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 4, attempts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	attempts, err = IfNecessaryWithCount(ctx, func() error {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+		return syscall.ECONNRESET
+	}, options)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 2, attempts)
+}
+
+func TestMaxElapsedTime(t *testing.T) {
+	// Without MaxRetry, only the elapsed time limits the retries.
+	start := time.Now()
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{Delay: 10 * time.Millisecond, MaxElapsedTime: 50 * time.Millisecond})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Greater(t, attempts, 2)
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// The first limit reached wins.
+	attempts, err = IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 2, Delay: time.Millisecond, MaxElapsedTime: time.Minute})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 3, attempts)
+}
+
+func TestMaxAttempts(t *testing.T) {
+	for _, tc := range []struct {
+		options  *Options
+		attempts int
+	}{
+		{&Options{}, 1},
+		{&Options{MaxRetry: 0}, 1},
+		{&Options{MaxAttempts: 1}, 1},
+		{&Options{MaxAttempts: 1, MaxRetry: 5}, 1},
+		{&Options{MaxAttempts: 1, MaxElapsedTime: time.Hour}, 1},
+		{&Options{MaxAttempts: 3}, 3},
+		{&Options{MaxAttempts: 3, MaxRetry: 1}, 3},
+		{&Options{MaxRetry: 2}, 3},
+	} {
+		tc.options.Clock = newFakeClock()
+		attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, tc.options)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		require.Equal(t, tc.attempts, attempts, "%+v", tc.options)
+		require.Len(t, tc.options.DelaySchedule(), tc.attempts-1, "%+v", tc.options)
+	}
+	require.Error(t, (&Options{MaxAttempts: -1}).Validate())
+}
+
+func TestNoSleepAfterLastAttempt(t *testing.T) {
+	for _, options := range []*Options{
+		{MaxRetry: 3},
+		{MaxAttempts: 4},
+		{MaxRetry: 3, Strategy: BackoffLinear, ImmediateAttempts: 1},
+		{MaxRetry: 3, Delay: time.Minute, AggregateErrors: true},
+	} {
+		clock := newFakeClock()
+		options.Clock = clock
+		attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, options)
+		require.True(t, IsExhausted(err))
+		require.Equal(t, 4, attempts)
+		// Only the delays between the attempts are waited.
+		require.Equal(t, options.DelaySchedule(), clock.Slept(), "%+v", options)
+		var retryErr *Error
+		require.ErrorAs(t, err, &retryErr)
+		var total time.Duration
+		for _, delay := range options.DelaySchedule() {
+			total += delay
+		}
+		require.Equal(t, total, retryErr.SleepTime, "%+v", options)
+		require.Equal(t, total, retryErr.Elapsed, "%+v", options)
+	}
+
+	// Neither when the elapsed time limit is reached.
+	clock := newFakeClock()
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{Delay: time.Second, MaxElapsedTime: 3 * time.Second, Clock: clock})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 4, attempts)
+	require.Equal(t, []time.Duration{time.Second, time.Second, time.Second}, clock.Slept())
+}
+
+func TestMaxTotalDelay(t *testing.T) {
+	// 1s + 2s + 4s fit in 10s, 8s more would not.
+	clock := newFakeClock()
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 10, MaxTotalDelay: 10 * time.Second, Clock: clock})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 4, attempts)
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, clock.Slept())
+}
+
+func TestMinInterval(t *testing.T) {
+	clock := newFakeClock()
+	var starts []time.Time
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		starts = append(starts, clock.Now())
+		calls++
+		// The operation is slow, more so on its second attempt.
+		if calls == 2 {
+			<-clock.After(3 * time.Second)
+		} else {
+			<-clock.After(800 * time.Millisecond)
+		}
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 3, Delay: 200 * time.Millisecond, MinInterval: 2 * time.Second, Clock: clock})
+	require.True(t, IsExhausted(err))
+	require.Len(t, starts, 4)
+	// The delays are extended to 1.2s, except after the attempt taking 3s.
+	require.Equal(t, []time.Duration{2 * time.Second, 3200 * time.Millisecond, 2 * time.Second}, []time.Duration{
+		starts[1].Sub(starts[0]),
+		starts[2].Sub(starts[1]),
+		starts[3].Sub(starts[2]),
+	})
+
+	// Longer delays are not affected.
+	clock = newFakeClock()
+	err = IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 2, MinInterval: 500 * time.Millisecond, Clock: clock})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second}, clock.Slept())
+	require.Error(t, (&Options{MinInterval: -time.Second}).Validate())
+}
+
+func TestFakeClock(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 10, Clock: clock})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 11, attempts)
+	// 1s + 2s + ... + 512s of backoff, simulated instantly.
+	require.Equal(t, 1023*time.Second, clock.Now().Sub(start))
+	require.Len(t, clock.Slept(), 10)
+}
+
+func TestWallClockJump(t *testing.T) {
+	// If the elapsed time were computed from the wall time, it would be
+	// negative after the jump, and only MaxRetry would stop the loop.
+	clock := newJumpingClock()
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 100, Delay: time.Second, MaxElapsedTime: 10 * time.Second, Clock: clock})
+	var retryErr *Error
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, 11, attempts)
+	require.Equal(t, 10*time.Second, retryErr.Elapsed)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []*Options{nil, {MaxRetry: -1}} {
+		calls := 0
+		err := IfNecessary(context.Background(), func() error {
+			calls++
+			return syscall.ECONNRESET
+		}, options)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		require.Equal(t, 1, calls)
+	}
+
+	for _, tc := range []struct {
+		options *Options
+		valid   bool
+	}{
+		{nil, true},
+		{&Options{}, true},
+		{&Options{MaxRetry: 3, BaseDelay: time.Millisecond, Factor: 1.5, Strategy: BackoffDecorrelated}, true},
+		{&Options{MaxRetry: -1}, false},
+		{&Options{Delay: -time.Second}, false},
+		{&Options{BaseDelay: -time.Second}, false},
+		{&Options{MaxDelay: -time.Second}, false},
+		{&Options{AttemptTimeout: -time.Second}, false},
+		{&Options{MaxElapsedTime: -time.Second}, false},
+		{&Options{Factor: 0.5}, false},
+		{&Options{EquilibriumJitter: 0.2}, true},
+		{&Options{EquilibriumJitter: 1.5}, false},
+		{&Options{MaxConsecutiveSameError: -1}, false},
+		{&Options{RandomizationFactor: 0.5}, true},
+		{&Options{RandomizationFactor: -0.5}, false},
+		{&Options{ImmediateAttempts: -1}, false},
+		{&Options{Strategy: -1}, false},
+	} {
+		if tc.valid {
+			require.NoError(t, tc.options.Validate(), "%+v", tc.options)
+		} else {
+			require.Error(t, tc.options.Validate(), "%+v", tc.options)
+		}
+	}
+}
+
+func TestMaxConsecutiveSameError(t *testing.T) {
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		return fmt.Errorf("connecting to registry.example: %w", syscall.ECONNREFUSED)
+	}, &Options{MaxRetry: 10, MaxConsecutiveSameError: 3, Clock: newFakeClock()})
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	require.False(t, IsExhausted(err))
+	require.Equal(t, 3, calls)
+
+	// Changing errors are retried until the retries are exhausted.
+	failures := []error{syscall.ECONNRESET, syscall.ECONNRESET, syscall.ETIMEDOUT, syscall.ECONNRESET, syscall.ECONNRESET, syscall.ETIMEDOUT}
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return failures[calls-1]
+	}, &Options{MaxRetry: len(failures) - 1, MaxConsecutiveSameError: 3, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, len(failures), calls)
+}
+
+func TestInitialDelay(t *testing.T) {
+	clock := newFakeClock()
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, Delay: time.Second, InitialDelay: time.Minute, Clock: clock})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 2, attempts)
+	require.Equal(t, []time.Duration{time.Minute, time.Second}, clock.Slept())
+
+	clock = newFakeClock()
+	_, err = IfNecessaryWithCount(context.Background(), func() error {
+		return nil
+	}, &Options{InitialDelay: time.Minute, Jitter: true, Rand: rand.New(rand.NewSource(1)), Clock: clock})
+	require.NoError(t, err)
+	require.Len(t, clock.Slept(), 1)
+	require.Less(t, clock.Slept()[0], time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts, err = IfNecessaryWithCount(ctx, func() error {
+		return nil
+	}, &Options{InitialDelay: time.Minute})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 0, attempts)
+}
+
+func TestJitterFirstAttemptOnly(t *testing.T) {
+	slept := func(options *Options) []time.Duration {
+		clock := newFakeClock()
+		options.Clock = clock
+		err := IfNecessary(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, options)
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		return clock.Slept()
+	}
+	first := slept(&Options{MaxRetry: 3, BaseDelay: time.Second, Jitter: true, JitterFirstAttemptOnly: true, Rand: rand.New(rand.NewSource(1))})
+	require.Len(t, first, 4)
+	require.Less(t, first[0], time.Second)
+	require.NotEqual(t, time.Duration(0), first[0])
+	// Only the start is randomized, the retries use the plain backoff.
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}, first[1:])
+	require.Equal(t, first, slept(&Options{MaxRetry: 3, BaseDelay: time.Second, Jitter: true, JitterFirstAttemptOnly: true, Rand: rand.New(rand.NewSource(1))}))
+
+	// InitialDelay bounds the randomized start instead of BaseDelay.
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 10; i++ {
+		delays := slept(&Options{MaxRetry: 1, BaseDelay: time.Second, InitialDelay: time.Minute, JitterFirstAttemptOnly: true, Rand: rng})
+		require.Less(t, delays[0], time.Minute)
+		require.Equal(t, time.Second, delays[1])
+	}
+}
+
+func TestSpreadStartup(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		clock := newFakeClock()
+		_, err := IfNecessaryWithCount(context.Background(), func() error {
+			return syscall.ECONNRESET
+		}, &Options{MaxRetry: 1, Delay: time.Second, SpreadStartup: time.Minute, Rand: rng, Clock: clock})
+		require.ErrorIs(t, err, syscall.ECONNRESET)
+		slept := clock.Slept()
+		require.Len(t, slept, 2)
+		require.GreaterOrEqual(t, slept[0], time.Duration(0))
+		require.Less(t, slept[0], time.Minute)
+		// The retries are not affected.
+		require.Equal(t, time.Second, slept[1])
+	}
+
+	clock := newFakeClock()
+	err := IfNecessary(context.Background(), func() error {
+		return nil
+	}, &Options{InitialDelay: time.Hour, SpreadStartup: time.Minute, Rand: rng, Clock: clock})
+	require.NoError(t, err)
+	require.Len(t, clock.Slept(), 1)
+	require.GreaterOrEqual(t, clock.Slept()[0], time.Hour)
+	require.Less(t, clock.Slept()[0], time.Hour+time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	err = IfNecessary(ctx, func() error {
+		calls++
+		return nil
+	}, &Options{SpreadStartup: time.Hour})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, 0, calls)
+}
+
+func TestSuccessPredicate(t *testing.T) {
+	errPending := errors.New("pending")
+	errReady := errors.New("ready")
+	calls := 0
+	err := IfNecessary(context.Background(), func() error {
+		calls++
+		if calls < 3 {
+			return Retryable(errPending)
+		}
+		return fmt.Errorf("status: %w", errReady)
+	}, &Options{
+		MaxRetry:         5,
+		SuccessPredicate: func(err error) bool { return errors.Is(err, errReady) },
+		// SuccessPredicate takes precedence.
+		DoNotRetryOn: []error{errReady},
+		Clock:        newFakeClock(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry:         2,
+		SuccessPredicate: func(err error) bool { return errors.Is(err, errReady) },
+		Clock:            newFakeClock(),
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 3, calls)
+}
+
+func TestRetryOn(t *testing.T) {
+	errTokenExpired := errors.New("token expired")
+	options := &Options{MaxRetry: 2, RetryOn: []error{io.EOF, errTokenExpired}, Clock: newFakeClock()}
+	for _, tc := range []struct {
+		err      error
+		attempts int
+	}{
+		{io.EOF, 3},
+		{fmt.Errorf("refreshing: %w", errTokenExpired), 3},
+		// Retryable by default, but not listed.
+		{syscall.ECONNRESET, 1},
+	} {
+		attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+			return tc.err
+		}, options)
+		require.ErrorIs(t, err, tc.err)
+		require.Equal(t, tc.attempts, attempts, "%v", tc.err)
+	}
+}
+
+func TestDoNotRetryOn(t *testing.T) {
+	errQuotaExceeded := errors.New("quota exceeded")
+	options := &Options{
+		MaxRetry:           2,
+		RetryOn:            []error{errQuotaExceeded},
+		RetryablePredicate: func(error) bool { return true },
+		DoNotRetryOn:       []error{errQuotaExceeded},
+		Clock:              newFakeClock(),
+	}
+	for _, tc := range []struct {
+		err      error
+		attempts int
+	}{
+		{errQuotaExceeded, 1},
+		{fmt.Errorf("pushing: %w", errQuotaExceeded), 1},
+		{Retryable(errQuotaExceeded), 1},
+	} {
+		attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+			return tc.err
+		}, options)
+		require.ErrorIs(t, err, errQuotaExceeded)
+		require.Equal(t, tc.attempts, attempts, "%v", tc.err)
+	}
+
+	options.RetryOn = nil
+	attempts, err := IfNecessaryWithCount(context.Background(), func() error {
+		return errors.New("other")
+	}, options)
+	require.Error(t, err)
+	require.Equal(t, 3, attempts)
+}
+
+func TestIf(t *testing.T) {
+	notFound := errors.New("not found yet")
+	calls := 0
+	err := If(context.Background(), func() (bool, error) {
+		calls++
+		if calls < 3 {
+			return true, notFound
+		}
+		return false, nil
+	}, &Options{MaxRetry: 5, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, 3, calls)
+
+	// A retryable error is not retried if the operation says so.
+	calls = 0
+	err = If(context.Background(), func() (bool, error) {
+		calls++
+		return false, syscall.ECONNRESET
+	}, &Options{MaxRetry: 5, Clock: newFakeClock()})
+	require.Equal(t, syscall.ECONNRESET, err)
+	require.Equal(t, 1, calls)
+
+	// A retry can be requested without an error.
+	calls = 0
+	err = If(context.Background(), func() (bool, error) {
+		calls++
+		return true, nil
+	}, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.ErrorIs(t, err, ErrRetryRequested)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	err = If(context.Background(), func() (bool, error) {
+		calls++
+		return true, notFound
+	}, &Options{MaxRetry: 2, DoNotRetryOn: []error{notFound}, Clock: newFakeClock()})
+	require.ErrorIs(t, err, notFound)
+	require.Equal(t, 1, calls)
+}
+
+func TestIfNecessaryAllocations(t *testing.T) {
+	ctx := context.Background()
+	operation := func() error { return nil }
+	for _, options := range []*Options{nil, {}, {MaxRetry: 5, Jitter: true, Logger: logrus.New()}, DefaultOptions()} {
+		require.Zero(t, testing.AllocsPerRun(100, func() {
+			_ = IfNecessary(ctx, operation, options)
+		}), "%+v", options)
+	}
+}
+
+func BenchmarkIfNecessarySuccess(b *testing.B) {
+	ctx := context.Background()
+	options := DefaultOptions()
+	operation := func() error { return nil }
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := IfNecessary(ctx, operation, options); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
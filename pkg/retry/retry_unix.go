@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package retry
+
+import "syscall"
+
+// isRetryableSyscall returns true if errno reports a transient failure,
+// typically of a network connection.
+func isRetryableSyscall(errno syscall.Errno) bool {
+	switch errno {
+	case syscall.ENOSPC, syscall.EROFS, syscall.EACCES, syscall.EDQUOT:
+		// Persistent conditions of a filesystem, e.g. a full disk, which
+		// do not clear up within a retry window.
+		return false
+	case syscall.ECONNREFUSED, syscall.EINTR, syscall.EAGAIN, syscall.EBUSY, syscall.ENETDOWN, syscall.ENETUNREACH, syscall.ENETRESET, syscall.ECONNABORTED, syscall.ECONNRESET, syscall.EPIPE, syscall.ETIMEDOUT, syscall.EHOSTDOWN, syscall.EHOSTUNREACH:
+		return true
+	}
+	return isErrnoERESTART(errno)
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package retry
+
+import (
+	"io/fs"
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryableSyscall(t *testing.T) {
+	for _, tc := range []struct {
+		errno     syscall.Errno
+		retryable bool
+	}{
+		{syscall.ECONNREFUSED, true},
+		{syscall.ECONNRESET, true},
+		{syscall.EHOSTUNREACH, true},
+		{syscall.ETIMEDOUT, true},
+		{syscall.ENOENT, false},
+		{syscall.EPERM, false},
+		{syscall.ENOSPC, false},
+		{syscall.EROFS, false},
+		{syscall.EACCES, false},
+		{syscall.EDQUOT, false},
+	} {
+		require.Equal(t, tc.retryable, isRetryableSyscall(tc.errno), tc.errno.Error())
+		require.Equal(t, tc.retryable, IsRetryable(&net.OpError{Op: "dial", Net: "tcp", Err: tc.errno}), tc.errno.Error())
+		require.Equal(t, tc.retryable, IsRetryable(&fs.PathError{Op: "write", Path: "/var/lib/containers/storage/tmp", Err: tc.errno}), tc.errno.Error())
+	}
+}
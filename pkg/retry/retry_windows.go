@@ -0,0 +1,18 @@
+package retry
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// isRetryableSyscall returns true if errno reports a transient failure,
+// typically of a network connection.  Sockets report Winsock error codes
+// on Windows, not the POSIX ones.
+func isRetryableSyscall(errno syscall.Errno) bool {
+	switch errno {
+	case windows.WSAECONNREFUSED, windows.WSAEINTR, windows.WSAEWOULDBLOCK, windows.WSAENETDOWN, windows.WSAENETUNREACH, windows.WSAENETRESET, windows.WSAECONNABORTED, windows.WSAECONNRESET, windows.WSAETIMEDOUT, windows.WSAEHOSTDOWN, windows.WSAEHOSTUNREACH, windows.ERROR_BROKEN_PIPE:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,27 @@
+package retry
+
+import (
+	"net"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/windows"
+)
+
+func TestIsRetryableSyscall(t *testing.T) {
+	for _, tc := range []struct {
+		errno     syscall.Errno
+		retryable bool
+	}{
+		{windows.WSAECONNREFUSED, true},
+		{windows.WSAECONNRESET, true},
+		{windows.WSAEHOSTUNREACH, true},
+		{windows.WSAETIMEDOUT, true},
+		{windows.ERROR_FILE_NOT_FOUND, false},
+		{windows.WSAEACCES, false},
+	} {
+		require.Equal(t, tc.retryable, isRetryableSyscall(tc.errno), tc.errno.Error())
+		require.Equal(t, tc.retryable, IsRetryable(&net.OpError{Op: "dial", Net: "tcp", Err: tc.errno}), tc.errno.Error())
+	}
+}
@@ -0,0 +1,206 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/semaphore"
+)
+
+// Retryer retries operations using the same Options, including their Logger,
+// Metrics and other hooks, so that they are configured only once.
+type Retryer struct {
+	options  Options
+	outcomes *outcomes // Set if RetryerOptions.Adaptive.
+
+	operations, successes, retries, exhausted atomic.Int64
+}
+
+// Stats are the lifetime totals of the operations retried by a Retryer.
+type Stats struct {
+	Operations int64 // The operations started.
+	Successes  int64 // The operations which eventually succeeded.
+	Retries    int64 // The retries of all the operations.
+	Exhausted  int64 // The operations which failed after exhausting their retries.
+}
+
+// RetryerOptions are the options of a Retryer which apply to all the
+// operations it retries together, unlike the Options of every operation.
+type RetryerOptions struct {
+	// ConcurrencyLimit, if set, limits how many of the operations retried by
+	// the Retryer can wait between attempts at the same time.  An operation
+	// due for a retry while the limit is reached blocks, in addition to its
+	// delay, until another one resumes or ctx is done; it does not fail.
+	ConcurrencyLimit int
+	// Adaptive makes the Retryer scale the delays of every operation
+	// according to the failure rate of the last 20 attempts of its previous
+	// operations: from 1 if none of them failed, to 8 if all of them failed,
+	// so that it backs off further during a sustained outage and recovers
+	// its usual delays once attempts succeed again.  MaxDelay still caps the
+	// scaled delays.
+	Adaptive bool
+	// RetryWindowLimit, if set, caps the number of retries the Retryer
+	// issues across all its operations within any RetryWindow, 1 minute if
+	// not set, as a coarse safety valve against retry storms.  Once the cap
+	// is reached, operations are not retried until the oldest retries leave
+	// the window: the loop returns the error of the last attempt.
+	RetryWindowLimit int
+	RetryWindow      time.Duration
+}
+
+// Validate returns an error if the options contain invalid values.  A nil
+// *RetryerOptions is valid.
+func (o *RetryerOptions) Validate() error {
+	if o == nil {
+		return nil
+	}
+	if o.ConcurrencyLimit < 0 {
+		return fmt.Errorf("invalid retryer options: ConcurrencyLimit %d is negative", o.ConcurrencyLimit)
+	}
+	if o.RetryWindowLimit < 0 {
+		return fmt.Errorf("invalid retryer options: RetryWindowLimit %d is negative", o.RetryWindowLimit)
+	}
+	if o.RetryWindow < 0 {
+		return fmt.Errorf("invalid retryer options: RetryWindow %s is negative", o.RetryWindow)
+	}
+	return nil
+}
+
+// NewRetryer returns a Retryer using a copy of options for every operation,
+// and retryerOptions for all of them.  A nil options means operations are not
+// retried, and a nil retryerOptions sets no shared limit.
+func NewRetryer(options *Options, retryerOptions *RetryerOptions) *Retryer {
+	r := &Retryer{}
+	if options != nil {
+		r.options = *options
+	}
+	if retryerOptions == nil {
+		retryerOptions = &RetryerOptions{}
+	}
+	if retryerOptions.ConcurrencyLimit > 0 {
+		r.options.sleepers = semaphore.NewWeighted(int64(retryerOptions.ConcurrencyLimit))
+	}
+	if retryerOptions.Adaptive {
+		r.outcomes = &outcomes{}
+	}
+	if retryerOptions.RetryWindowLimit > 0 {
+		r.options.window = &retryWindow{limit: retryerOptions.RetryWindowLimit, length: retryerOptions.RetryWindow, clock: r.options.getClock()}
+		if r.options.window.length == 0 {
+			r.options.window.length = defaultRetryWindow
+		}
+	}
+	onRetry := r.options.OnRetry
+	r.options.OnRetry = func(attempt int, delay time.Duration, err error) {
+		r.retries.Add(1)
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+	}
+	return r
+}
+
+// Stats returns the totals of the operations retried by r so far.
+func (r *Retryer) Stats() Stats {
+	return Stats{
+		Operations: r.operations.Load(),
+		Successes:  r.successes.Load(),
+		Retries:    r.retries.Load(),
+		Exhausted:  r.exhausted.Load(),
+	}
+}
+
+// observe counts an operation which ended with err, and returns err.
+func (r *Retryer) observe(err error) error {
+	switch {
+	case err == nil:
+		r.successes.Add(1)
+	case IsExhausted(err):
+		r.exhausted.Add(1)
+	}
+	return err
+}
+
+// Do retries the operation like IfNecessary.
+func (r *Retryer) Do(ctx context.Context, operation func() error) error {
+	r.operations.Add(1)
+	if r.outcomes == nil {
+		return r.observe(IfNecessary(ctx, operation, &r.options))
+	}
+	return r.observe(IfNecessary(ctx, func() error {
+		err := operation()
+		r.outcomes.record(err != nil)
+		return err
+	}, r.adaptedOptions()))
+}
+
+// DoCtx retries the operation like IfNecessaryCtx.
+func (r *Retryer) DoCtx(ctx context.Context, operation func(ctx context.Context) error) error {
+	r.operations.Add(1)
+	if r.outcomes == nil {
+		return r.observe(IfNecessaryCtx(ctx, operation, &r.options))
+	}
+	return r.observe(IfNecessaryCtx(ctx, func(ctx context.Context) error {
+		err := operation(ctx)
+		r.outcomes.record(err != nil)
+		return err
+	}, r.adaptedOptions()))
+}
+
+// DoWithResult retries the operation with r like IfNecessaryWithResult.  It
+// is not a method because methods cannot have type parameters.
+func DoWithResult[T any](ctx context.Context, r *Retryer, operation func() (T, error)) (T, error) {
+	var result T
+	err := r.Do(ctx, func() error {
+		var err error
+		result, err = operation()
+		return err
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
+
+// adaptedOptions returns a copy of the options of an adaptive Retryer, with
+// the delays scaled according to the recent failure rate.
+func (r *Retryer) adaptedOptions() *Options {
+	options := r.options
+	multiplier := r.outcomes.multiplier()
+	options.BaseDelay = saturate(float64(options.baseDelay()) * multiplier)
+	options.Delay = saturate(float64(options.Delay) * multiplier)
+	return &options
+}
+
+// defaultRetryWindow is the RetryWindow used if only RetryWindowLimit is set.
+const defaultRetryWindow = time.Minute
+
+// retryWindow caps the number of retries within a sliding window of time.
+type retryWindow struct {
+	limit  int
+	length time.Duration
+	clock  Clock
+
+	mu    sync.Mutex
+	times []time.Time // The times of the retries in the window, oldest first.
+}
+
+// allow records a retry and returns true if the cap is not reached.
+func (w *retryWindow) allow() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	now := w.clock.Now()
+	expired := 0
+	for expired < len(w.times) && now.Sub(w.times[expired]) >= w.length {
+		expired++
+	}
+	w.times = w.times[expired:]
+	if len(w.times) >= w.limit {
+		return false
+	}
+	w.times = append(w.times, now)
+	return true
+}
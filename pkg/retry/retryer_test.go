@@ -0,0 +1,283 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryer(t *testing.T) {
+	metrics := &testMetrics{}
+	options := &Options{MaxRetry: 2, Metrics: metrics, Clock: newFakeClock()}
+	r := NewRetryer(options, nil)
+	// Later changes to the options do not affect the Retryer.
+	options.MaxRetry = 0
+
+	calls := 0
+	err := r.Do(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 3, calls)
+
+	calls = 0
+	result, err := DoWithResult(context.Background(), r, func() (int, error) {
+		calls++
+		if calls < 2 {
+			return 0, syscall.ECONNRESET
+		}
+		return 42, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 42, result)
+	require.Equal(t, []int{3, 2}, metrics.attempts)
+
+	calls = 0
+	err = NewRetryer(nil, nil).Do(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, 1, calls)
+}
+
+// sleepCountingClock is a real clock which tracks how many callers wait
+// for After at the same time.
+type sleepCountingClock struct {
+	realClock
+	sleeping, maxSleeping int32
+}
+
+func (c *sleepCountingClock) After(d time.Duration) <-chan time.Time {
+	n := atomic.AddInt32(&c.sleeping, 1)
+	for {
+		max := atomic.LoadInt32(&c.maxSleeping)
+		if n <= max || atomic.CompareAndSwapInt32(&c.maxSleeping, max, n) {
+			break
+		}
+	}
+	ch := make(chan time.Time, 1)
+	go func() {
+		time.Sleep(d)
+		atomic.AddInt32(&c.sleeping, -1)
+		ch <- time.Now()
+	}()
+	return ch
+}
+
+func TestRetryerConcurrencyLimit(t *testing.T) {
+	clock := &sleepCountingClock{}
+	r := NewRetryer(&Options{
+		MaxRetry: 3,
+		Delay:    2 * time.Millisecond,
+		Logger:   logrus.New(),
+		Clock:    clock,
+	}, &RetryerOptions{ConcurrencyLimit: 2})
+	var (
+		wg    sync.WaitGroup
+		calls int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			attempts := 0
+			err := r.Do(context.Background(), func() error {
+				atomic.AddInt32(&calls, 1)
+				attempts++
+				if attempts < 3 {
+					return syscall.ECONNRESET
+				}
+				return nil
+			})
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(60), atomic.LoadInt32(&calls))
+	require.LessOrEqual(t, atomic.LoadInt32(&clock.maxSleeping), int32(2))
+
+	// Waiting for the limit stops when ctx is done.
+	r = NewRetryer(&Options{MaxRetry: 1, Delay: time.Hour, Logger: logrus.New()}, &RetryerOptions{ConcurrencyLimit: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	go func() {
+		_ = r.Do(ctx, func() error {
+			close(started)
+			return syscall.ECONNRESET
+		})
+	}()
+	<-started
+	done := make(chan error)
+	go func() {
+		done <- r.Do(ctx, func() error { return syscall.ECONNRESET })
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	require.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestRetryerAdaptive(t *testing.T) {
+	clock := newFakeClock()
+	r := NewRetryer(&Options{MaxRetry: 1, BaseDelay: time.Second, Strategy: BackoffConstant, Clock: clock}, &RetryerOptions{Adaptive: true})
+	failing := func() error {
+		return syscall.ECONNRESET
+	}
+	succeeding := func() error {
+		return nil
+	}
+	lastDelay := func() time.Duration {
+		slept := clock.Slept()
+		return slept[len(slept)-1]
+	}
+
+	// Sustained failures increase the delay, up to 8 times.
+	require.ErrorIs(t, r.Do(context.Background(), failing), syscall.ECONNRESET)
+	require.Equal(t, time.Second, lastDelay())
+	require.ErrorIs(t, r.Do(context.Background(), failing), syscall.ECONNRESET)
+	require.Equal(t, 8*time.Second, lastDelay())
+	for i := 0; i < 10; i++ {
+		require.ErrorIs(t, r.Do(context.Background(), failing), syscall.ECONNRESET)
+	}
+	require.Equal(t, 8*time.Second, lastDelay())
+
+	// Successes decrease it, back to the usual delay.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, r.Do(context.Background(), succeeding))
+	}
+	calls := 0
+	require.NoError(t, r.Do(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}))
+	require.Equal(t, 4500*time.Millisecond, lastDelay())
+	for i := 0; i < 20; i++ {
+		require.NoError(t, r.Do(context.Background(), succeeding))
+	}
+	require.ErrorIs(t, r.Do(context.Background(), failing), syscall.ECONNRESET)
+	require.Equal(t, time.Second, lastDelay())
+
+	// MaxDelay caps the scaled delays.
+	clock = newFakeClock()
+	r = NewRetryer(&Options{MaxRetry: 1, BaseDelay: time.Second, MaxDelay: 3 * time.Second, Clock: clock}, &RetryerOptions{Adaptive: true})
+	for i := 0; i < 5; i++ {
+		require.ErrorIs(t, r.Do(context.Background(), failing), syscall.ECONNRESET)
+	}
+	require.Equal(t, 3*time.Second, lastDelay())
+}
+
+func TestRetryerStats(t *testing.T) {
+	r := NewRetryer(&Options{MaxRetry: 2, Clock: newFakeClock()}, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			attempts := 0
+			_ = r.Do(context.Background(), func() error {
+				attempts++
+				switch {
+				case i%4 == 0: // Exhausted after 2 retries.
+					return syscall.ECONNRESET
+				case i%4 == 1: // Not retried.
+					return syscall.EPERM
+				case attempts < 3:
+					return syscall.ECONNRESET
+				}
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, Stats{Operations: 20, Successes: 10, Retries: 30, Exhausted: 5}, r.Stats())
+	require.Equal(t, Stats{}, NewRetryer(nil, nil).Stats())
+}
+
+func TestRetryerRetryWindowLimit(t *testing.T) {
+	// At most 2 retries every minute: the third one, after 40s, does not happen.
+	clock := newFakeClock()
+	r := NewRetryer(&Options{MaxRetry: 5, Delay: 20 * time.Second, Clock: clock}, &RetryerOptions{RetryWindowLimit: 2})
+	calls := 0
+	err := r.Do(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	require.Equal(t, syscall.ECONNRESET, err)
+	require.Equal(t, 3, calls)
+	require.Equal(t, Stats{Operations: 1, Retries: 2}, r.Stats())
+
+	// Retries are allowed again once the oldest ones leave the window.
+	r = NewRetryer(&Options{MaxRetry: 5, Delay: 40 * time.Second, Clock: newFakeClock()}, &RetryerOptions{RetryWindowLimit: 2})
+	calls = 0
+	err = r.Do(context.Background(), func() error {
+		calls++
+		return syscall.ECONNRESET
+	})
+	require.True(t, IsExhausted(err))
+	require.Equal(t, 6, calls)
+
+	// The cap applies to concurrent operations.
+	r = NewRetryer(&Options{MaxRetry: 3, Delay: time.Millisecond, Clock: newFakeClock()}, &RetryerOptions{RetryWindowLimit: 10, RetryWindow: time.Hour})
+	var (
+		wg          sync.WaitGroup
+		sharedCalls int32
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.Do(context.Background(), func() error {
+				atomic.AddInt32(&sharedCalls, 1)
+				return syscall.ECONNRESET
+			})
+			require.ErrorIs(t, err, syscall.ECONNRESET)
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(30), atomic.LoadInt32(&sharedCalls))
+	stats := r.Stats()
+	require.Equal(t, int64(20), stats.Operations)
+	require.Equal(t, int64(10), stats.Retries)
+	require.Zero(t, stats.Successes)
+
+	// Retries given up for another reason do not count.
+	r = NewRetryer(&Options{
+		MaxRetry:      1,
+		Delay:         time.Second,
+		MaxTotalDelay: 10 * time.Second,
+		DelayForError: func(err error, _ int) (time.Duration, bool) {
+			return time.Minute, errors.Is(err, syscall.ECONNREFUSED)
+		},
+		Clock: newFakeClock(),
+	}, &RetryerOptions{RetryWindowLimit: 1})
+	err = r.Do(context.Background(), func() error {
+		return syscall.ECONNREFUSED
+	})
+	require.Equal(t, syscall.ECONNREFUSED, err)
+	calls = 0
+	err = r.Do(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, calls)
+
+	require.Error(t, (&RetryerOptions{RetryWindowLimit: -1}).Validate())
+	require.Error(t, (&RetryerOptions{RetryWindow: -time.Second}).Validate())
+	require.Error(t, (&RetryerOptions{ConcurrencyLimit: -1}).Validate())
+	require.NoError(t, (*RetryerOptions)(nil).Validate())
+}
@@ -0,0 +1,50 @@
+// Package retrygrpc makes the retry package classify the status errors
+// returned by gRPC clients, for the programs which opt in by calling
+// Register; the retry package itself does not depend on gRPC.
+package retrygrpc
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/containers/common/pkg/retry"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var registerOnce sync.Once
+
+// Register makes retry.IsRetryable, and the retry loops relying on it,
+// classify the errors carrying a gRPC status.  It can be called more than
+// once, e.g. by several libraries; the classifier is only registered once.
+func Register() {
+	registerOnce.Do(func() {
+		retry.RegisterClassifier(classify)
+	})
+}
+
+// statusError is implemented by the errors returned by gRPC clients.
+type statusError interface {
+	GRPCStatus() *status.Status
+}
+
+// classify is the classifier registered by Register.
+func classify(err error) (retryable, handled bool) {
+	var statusErr statusError
+	if !errors.As(err, &statusErr) {
+		return false, false
+	}
+	return isRetryable(statusErr.GRPCStatus().Code()), true
+}
+
+// isRetryable returns true if a gRPC call failing with code may succeed
+// when repeated.
+func isRetryable(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.ResourceExhausted, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	}
+	// Anything else, notably InvalidArgument, NotFound, PermissionDenied
+	// and Unauthenticated, will fail the same way again.
+	return false
+}
@@ -0,0 +1,41 @@
+package retrygrpc
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/containers/common/pkg/retry"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// retryableBeforeRegister is computed once per test binary, before any test
+// calls Register, which cannot be undone.
+var retryableBeforeRegister = retry.IsRetryable(status.Error(codes.Unavailable, "test"))
+
+func TestRegister(t *testing.T) {
+	require.False(t, retryableBeforeRegister)
+	Register()
+	Register()
+	for _, tc := range []struct {
+		code      codes.Code
+		retryable bool
+	}{
+		{codes.Unavailable, true},
+		{codes.ResourceExhausted, true},
+		{codes.Aborted, true},
+		{codes.DeadlineExceeded, true},
+		{codes.InvalidArgument, false},
+		{codes.NotFound, false},
+		{codes.PermissionDenied, false},
+		{codes.Unauthenticated, false},
+		{codes.Internal, false},
+	} {
+		err := status.Error(tc.code, "test")
+		require.Equal(t, tc.retryable, retry.IsRetryable(err), "%s", tc.code)
+		require.Equal(t, tc.retryable, retry.IsRetryable(fmt.Errorf("calling service: %w", err)), "%s", tc.code)
+	}
+	// Other errors are classified as before.
+	require.False(t, retry.IsRetryable(fmt.Errorf("test")))
+}
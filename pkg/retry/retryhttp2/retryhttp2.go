@@ -0,0 +1,43 @@
+// Package retryhttp2 makes the retry package classify the errors of the
+// golang.org/x/net/http2 transport, for the programs which opt in by calling
+// Register; the retry package itself does not depend on golang.org/x/net.  The
+// errors of the HTTP/2 implementation bundled in net/http are not exported,
+// and cannot be recognized.
+package retryhttp2
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/containers/common/pkg/retry"
+	"golang.org/x/net/http2"
+)
+
+var registerOnce sync.Once
+
+// Register makes retry.IsRetryable, and the retry loops relying on it,
+// classify the HTTP/2 stream and GOAWAY errors.  It can be called more than
+// once, e.g. by several libraries; the classifier is only registered once.
+func Register() {
+	registerOnce.Do(func() {
+		retry.RegisterClassifier(classify)
+	})
+}
+
+// classify is the classifier registered by Register.
+func classify(err error) (retryable, handled bool) {
+	var (
+		streamErr http2.StreamError
+		goAwayErr http2.GoAwayError
+	)
+	switch {
+	case errors.As(err, &streamErr):
+		// The server refused the stream before processing the request.
+		return streamErr.Code == http2.ErrCodeRefusedStream, true
+	case errors.As(err, &goAwayErr):
+		// The server is shutting down gracefully, e.g. for a restart;
+		// anything else reports a protocol error.
+		return goAwayErr.ErrCode == http2.ErrCodeNo, true
+	}
+	return false, false
+}
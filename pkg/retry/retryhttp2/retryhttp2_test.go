@@ -0,0 +1,35 @@
+package retryhttp2
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/containers/common/pkg/retry"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+// retryableBeforeRegister is computed once per test binary, before any test
+// calls Register, which cannot be undone.
+var retryableBeforeRegister = retry.IsRetryable(http2.StreamError{StreamID: 3, Code: http2.ErrCodeRefusedStream})
+
+func TestRegister(t *testing.T) {
+	require.False(t, retryableBeforeRegister)
+	Register()
+	Register()
+	for _, tc := range []struct {
+		err       error
+		retryable bool
+	}{
+		{http2.StreamError{StreamID: 3, Code: http2.ErrCodeRefusedStream}, true},
+		{http2.StreamError{StreamID: 3, Code: http2.ErrCodeProtocol}, false},
+		{http2.StreamError{StreamID: 3, Code: http2.ErrCodeCancel}, false},
+		{http2.GoAwayError{LastStreamID: 1, ErrCode: http2.ErrCodeNo}, true},
+		{http2.GoAwayError{LastStreamID: 1, ErrCode: http2.ErrCodeProtocol}, false},
+		{http2.GoAwayError{LastStreamID: 1, ErrCode: http2.ErrCodeEnhanceYourCalm}, false},
+	} {
+		require.Equal(t, tc.retryable, retry.IsRetryable(tc.err), "%v", tc.err)
+		err := &url.Error{Op: "Get", URL: "https://registry.example/v2/", Err: tc.err}
+		require.Equal(t, tc.retryable, retry.IsRetryable(err), "%v", err)
+	}
+}
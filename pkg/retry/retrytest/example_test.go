@@ -0,0 +1,30 @@
+package retrytest_test
+
+import (
+	"context"
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/containers/common/pkg/retry"
+	"github.com/containers/common/pkg/retry/retrytest"
+)
+
+func Example() {
+	options, clock, recorder := retrytest.Options(&retry.Options{
+		MaxRetry:  10,
+		BaseDelay: time.Second,
+		MaxDelay:  time.Minute,
+	})
+	attempts, err := retry.IfNecessaryWithCount(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, options)
+
+	fmt.Println(attempts, retry.IsExhausted(err))
+	fmt.Println(len(recorder.Retries()), recorder.Delays())
+	fmt.Println(clock.Since(time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)))
+	// Output:
+	// 11 true
+	// 10 [1s 2s 4s 8s 16s 32s 1m0s 1m0s 1m0s 1m0s]
+	// 5m3s
+}
@@ -0,0 +1,104 @@
+// Package retrytest provides helpers for testing code which retries
+// operations with the retry package, without waiting for the delays.
+package retrytest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/containers/common/pkg/retry"
+	"github.com/containers/common/pkg/retry/internal/fakeclock"
+)
+
+// FakeClock is a retry.Clock whose After returns immediately, advancing the
+// current time by the requested duration, so that retry loops complete
+// synchronously however long their delays are.
+type FakeClock struct {
+	clock *fakeclock.Clock
+}
+
+// NewFakeClock returns a FakeClock starting at now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{clock: fakeclock.New(now)}
+}
+
+// Now returns the current simulated time.
+func (c *FakeClock) Now() time.Time {
+	return c.clock.Now()
+}
+
+// Since returns the simulated time elapsed since t.
+func (c *FakeClock) Since(t time.Time) time.Duration {
+	return c.clock.Since(t)
+}
+
+// After advances the simulated time by d, and returns a channel which is
+// ready to receive it.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	return c.clock.After(d)
+}
+
+// Advance advances the simulated time by d without recording a sleep, e.g.
+// to simulate the duration of an operation.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.clock.Advance(d)
+}
+
+// Slept returns the durations passed to After so far.
+func (c *FakeClock) Slept() []time.Duration {
+	return c.clock.Slept()
+}
+
+// Recorder captures the retries of the Options it is installed in.
+type Recorder struct {
+	mu      sync.Mutex
+	retries []retry.Attempt
+}
+
+// Install makes options report their retries to r, in addition to the
+// OnRetry function already set, if any.
+func (r *Recorder) Install(options *retry.Options) {
+	onRetry := options.OnRetry
+	options.OnRetry = func(attempt int, delay time.Duration, err error) {
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.retries = append(r.retries, retry.Attempt{Number: attempt, Err: err, Delay: delay})
+	}
+}
+
+// Retries returns the retries recorded so far, in order.  The Number of each
+// is the 1-based retry number, Err the error of the failed attempt which
+// caused it, and Delay the delay before the retry.
+func (r *Recorder) Retries() []retry.Attempt {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]retry.Attempt(nil), r.retries...)
+}
+
+// Delays returns the delays before the retries recorded so far, in order.
+func (r *Recorder) Delays() []time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delays := make([]time.Duration, 0, len(r.retries))
+	for _, attempt := range r.retries {
+		delays = append(delays, attempt.Delay)
+	}
+	return delays
+}
+
+// Options returns a copy of options, which may be nil, using a new
+// FakeClock and reporting its retries to a new Recorder.
+func Options(options *retry.Options) (*retry.Options, *FakeClock, *Recorder) {
+	testOptions := retry.Options{}
+	if options != nil {
+		testOptions = *options
+	}
+	clock := NewFakeClock(time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC))
+	testOptions.Clock = clock
+	recorder := &Recorder{}
+	recorder.Install(&testOptions)
+	return &testOptions, clock, recorder
+}
@@ -0,0 +1,43 @@
+package retrytest
+
+import (
+	"context"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containers/common/pkg/retry"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2023, time.April, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	<-clock.After(time.Second)
+	clock.Advance(time.Minute)
+	<-clock.After(time.Hour)
+	require.Equal(t, start.Add(time.Hour+time.Minute+time.Second), clock.Now())
+	require.Equal(t, time.Hour+time.Minute+time.Second, clock.Since(start))
+	require.Equal(t, []time.Duration{time.Second, time.Hour}, clock.Slept())
+}
+
+func TestOptions(t *testing.T) {
+	var onRetry []int
+	options, clock, recorder := Options(&retry.Options{
+		MaxRetry: 2,
+		Delay:    time.Hour,
+		OnRetry: func(attempt int, _ time.Duration, _ error) {
+			onRetry = append(onRetry, attempt)
+		},
+	})
+	err := retry.IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, options)
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Equal(t, []int{1, 2}, onRetry)
+	require.Equal(t, []retry.Attempt{
+		{Number: 1, Err: syscall.ECONNRESET, Delay: time.Hour},
+		{Number: 2, Err: syscall.ECONNRESET, Delay: time.Hour},
+	}, recorder.Retries())
+	require.Equal(t, clock.Slept(), recorder.Delays())
+}
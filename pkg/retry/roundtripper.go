@@ -0,0 +1,191 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxDrainedBody is the number of bytes read from the body of a response
+// which is discarded before a retry, so that its connection can be reused.
+const maxDrainedBody = 4096
+
+// responseError reports a response whose status code is retryable.
+type responseError struct {
+	resp *http.Response
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("unexpected response status %q", e.resp.Status)
+}
+
+func (e *responseError) StatusCode() int {
+	return e.resp.StatusCode
+}
+
+// isIdempotent returns true if a request using method can be repeated after
+// being received by the server, as defined in RFC 9110 section 9.2.2.
+func isIdempotent(method string) bool {
+	switch method {
+	case "", http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// transportError returns err, the failure of a request using method to get
+// a response, reported as a sent request unless method is idempotent or err
+// is a failure to connect to the server, which happens before the request is
+// written.  Other failures, e.g. a connection reset while waiting for the
+// response, can happen after the server received the request.
+func transportError(err error, method string) error {
+	var opErr *net.OpError
+	if isIdempotent(method) || (errors.As(err, &opErr) && opErr.Op == "dial") {
+		return err
+	}
+	return Sent(err)
+}
+
+// responseRetryAfter returns a RetryAfter function reading the Retry-After
+// header of a response whose status code is retryable, with HTTP-dates
+// relative to the time of clock.
+func responseRetryAfter(clock Clock) func(err error) (time.Duration, bool) {
+	return func(err error) (time.Duration, bool) {
+		var respErr *responseError
+		if !errors.As(err, &respErr) {
+			return 0, false
+		}
+		return parseRetryAfter(respErr.resp.Header.Get("Retry-After"), clock.Now())
+	}
+}
+
+// roundTripper is the http.RoundTripper returned by NewRoundTripper.
+type roundTripper struct {
+	next    http.RoundTripper
+	options Options
+}
+
+// NewRoundTripper returns an http.RoundTripper sending requests through next,
+// http.DefaultTransport if nil, and retrying them with the retry Options, like
+// HTTP.  A request with a body is only retried if its GetBody is set, e.g. by
+// http.NewRequest, to send the body again.
+func NewRoundTripper(next http.RoundTripper, options *Options) http.RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &roundTripper{next: next, options: httpOptions(options)}
+}
+
+func (rt *roundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		// The body cannot be sent again.
+		return rt.next.RoundTrip(req)
+	}
+	return doHTTP(req.Context(), func(ctx context.Context) (*http.Response, error) {
+		attemptReq := req.WithContext(ctx)
+		if AttemptFromContext(ctx) > 1 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, Permanent(err)
+			}
+			attemptReq.Body = body
+		}
+		resp, err := rt.next.RoundTrip(attemptReq)
+		if err != nil {
+			return nil, transportError(err, req.Method)
+		}
+		if resp.Request == nil {
+			resp.Request = attemptReq
+		}
+		return resp, nil
+	}, &rt.options)
+}
+
+// HTTP retries an HTTP request made by do with the retry Options, like
+// IfNecessary, if it fails with a retryable error or gets a response with a
+// retryable status code, see StatusCoder, so that no RetryablePredicate is
+// needed to retry responses which net/http does not report as errors.
+// Unless RetryAfter is set, the Retry-After header of such a response sets
+// the delay before the retry.  Such a response is reported as a sent request,
+// see RequestSentReporter, unless the method of its Request is idempotent,
+// e.g. GET or PUT, so that the response to a POST is only retried if
+// Idempotent is set.  So is a failure of such a request reported by net/http
+// in a *url.Error, unless it failed to connect to the server.  The bodies of
+// the discarded responses are closed, and once the retries are exhausted, the
+// last response is returned as is.
+//
+// AttemptTimeout and HedgeDelay are ignored, because the response body is
+// read after do returns.
+func HTTP(ctx context.Context, do func() (*http.Response, error), options *Options) (*http.Response, error) {
+	httpOptions := httpOptions(options)
+	return doHTTP(ctx, func(context.Context) (*http.Response, error) {
+		resp, err := do()
+		var urlErr *url.Error
+		if err != nil && errors.As(err, &urlErr) {
+			// Op is the method of the request, e.g. "Post".
+			return nil, transportError(err, strings.ToUpper(urlErr.Op))
+		}
+		return resp, err
+	}, &httpOptions)
+}
+
+// httpOptions returns a copy of options suitable for doHTTP.
+func httpOptions(options *Options) Options {
+	httpOptions := Options{}
+	if options != nil {
+		httpOptions = *options
+	}
+	httpOptions.AttemptTimeout = 0
+	httpOptions.HedgeDelay = 0
+	if httpOptions.RetryAfter == nil {
+		httpOptions.RetryAfter = responseRetryAfter(httpOptions.getClock())
+	}
+	return httpOptions
+}
+
+// doHTTP implements HTTP, do being given the context of every attempt.
+func doHTTP(ctx context.Context, do func(ctx context.Context) (*http.Response, error), options *Options) (*http.Response, error) {
+	var resp *http.Response
+	err := IfNecessaryCtx(ctx, func(ctx context.Context) error {
+		if resp != nil {
+			// Discard the response of the previous attempt.
+			_, _ = io.CopyN(io.Discard, resp.Body, maxDrainedBody)
+			resp.Body.Close()
+			resp = nil
+		}
+		r, err := do(ctx)
+		if err != nil {
+			return err
+		}
+		resp = r
+		if isStatusCodeRetryable(r.StatusCode) || (options.Idempotent && r.StatusCode == http.StatusRequestTimeout) {
+			var err error = &responseError{resp: r}
+			if r.Request == nil || !isIdempotent(r.Request.Method) {
+				err = Sent(err)
+			}
+			return err
+		}
+		return nil
+	}, options)
+	if err == nil {
+		return resp, nil
+	}
+	var (
+		respErr *responseError
+		aborted *abortedError
+	)
+	if resp != nil && errors.As(err, &respErr) && !errors.As(err, &aborted) {
+		// Not retried any further: return the response itself.
+		return resp, nil
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return nil, err
+}
@@ -0,0 +1,297 @@
+package retry
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTripper(t *testing.T) {
+	var requests int32
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		bodies = append(bodies, string(body))
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	clock := newFakeClock()
+	client := &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 3, Idempotent: true, Clock: clock})}
+	resp, err := client.Post(server.URL, "text/plain", bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+	// The body was sent again, after the delays requested by the server.
+	require.Equal(t, []string{"payload", "payload", "payload"}, bodies)
+	require.Equal(t, []time.Duration{7 * time.Second, 7 * time.Second}, clock.Slept())
+
+	// Once the retries are exhausted, the last response is returned.
+	atomic.StoreInt32(&requests, -10)
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(-6), atomic.LoadInt32(&requests))
+
+	// A body which cannot be sent again is not retried.
+	atomic.StoreInt32(&requests, 0)
+	req, err := http.NewRequest(http.MethodPost, server.URL, io.NopCloser(strings.NewReader("payload")))
+	require.NoError(t, err)
+	require.Nil(t, req.GetBody)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// Nor is a request which is not idempotent, unless Idempotent is set.
+	atomic.StoreInt32(&requests, 0)
+	client = &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 3, Clock: newFakeClock()})}
+	resp, err = client.Post(server.URL, "text/plain", bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+	atomic.StoreInt32(&requests, 0)
+	resp, err = client.Do(&http.Request{Method: http.MethodPut, URL: req.URL, Body: http.NoBody})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestRoundTripperRetryAfterDate(t *testing.T) {
+	clock := newFakeClock()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.Header().Set("Retry-After", clock.Now().Add(20*time.Second).Format(http.TimeFormat))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 1, Clock: clock})}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, []time.Duration{20 * time.Second}, clock.Slept())
+}
+
+func TestRoundTripperRequestTimeout(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusRequestTimeout)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// 408 Request Timeout is only retried if Idempotent is set.
+	client := &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 1, Clock: newFakeClock()})}
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusRequestTimeout, resp.StatusCode)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	client = &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 1, Idempotent: true, Clock: newFakeClock()})}
+	resp, err = client.Post(server.URL, "text/plain", bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestRoundTripperResetAfterSent(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Reset the connection after receiving the request.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			require.NoError(t, conn.(*net.TCPConn).SetLinger(0))
+			conn.Close()
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	// A POST may have been received, and is not sent again.
+	client := &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 2, Clock: newFakeClock()})}
+	_, err := client.Post(server.URL, "text/plain", bytes.NewReader([]byte("payload")))
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	_, err = HTTP(context.Background(), func() (*http.Response, error) {
+		return http.Post(server.URL, "text/plain", bytes.NewReader([]byte("payload")))
+	}, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.Error(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// Unless Idempotent is set.
+	atomic.StoreInt32(&requests, 0)
+	client = &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 2, Idempotent: true, Clock: newFakeClock()})}
+	resp, err := client.Post(server.URL, "text/plain", bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// A PUT is idempotent.
+	atomic.StoreInt32(&requests, 0)
+	client = &http.Client{Transport: NewRoundTripper(nil, &Options{MaxRetry: 2, Clock: newFakeClock()})}
+	req, err := http.NewRequest(http.MethodPut, server.URL, bytes.NewReader([]byte("payload")))
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusCreated, resp.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	// A POST which failed to connect was not sent.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closedURL := "http://" + listener.Addr().String()
+	listener.Close()
+	attempts := 0
+	_, err = HTTP(context.Background(), func() (*http.Response, error) {
+		attempts++
+		return http.Post(closedURL, "text/plain", bytes.NewReader([]byte("payload")))
+	}, &Options{MaxRetry: 2, Clock: newFakeClock()})
+	require.Error(t, err)
+	require.Equal(t, 3, attempts)
+}
+
+// trackedBody records whether a response body was closed.
+type trackedBody struct {
+	io.ReadCloser
+	closed bool
+}
+
+func (b *trackedBody) Close() error {
+	b.closed = true
+	return b.ReadCloser.Close()
+}
+
+func TestHTTP(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch n := atomic.AddInt32(&requests, 1); {
+		case n == 1:
+			// A transport error.
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+		case n == 2:
+			w.WriteHeader(http.StatusBadGateway)
+		case n == 3:
+			w.Header().Set("Retry-After", "5")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case r.URL.Path == "/unimplemented":
+			w.WriteHeader(http.StatusNotImplemented)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+	defer server.Close()
+
+	var bodies []*trackedBody
+	do := func(path string) func() (*http.Response, error) {
+		return func() (*http.Response, error) {
+			resp, err := http.Get(server.URL + path)
+			if err != nil {
+				return nil, err
+			}
+			body := &trackedBody{ReadCloser: resp.Body}
+			bodies = append(bodies, body)
+			resp.Body = body
+			return resp, nil
+		}
+	}
+	clock := newFakeClock()
+	resp, err := HTTP(context.Background(), do("/"), &Options{MaxRetry: 3, Clock: clock})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "ok", string(body))
+	require.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	// The delay requested by the server is honored.
+	require.Equal(t, []time.Duration{time.Second, 2 * time.Second, 5 * time.Second}, clock.Slept())
+	// The discarded responses were closed.
+	require.Len(t, bodies, 3)
+	for _, body := range bodies {
+		require.True(t, body.closed)
+	}
+
+	// Other status codes are not retried.
+	bodies = nil
+	resp, err = HTTP(context.Background(), do("/unimplemented"), &Options{MaxRetry: 3, Clock: newFakeClock()})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotImplemented, resp.StatusCode)
+	require.Equal(t, int32(5), atomic.LoadInt32(&requests))
+
+	// Once the retries are exhausted, the last response is returned.
+	atomic.StoreInt32(&requests, 1)
+	bodies = nil
+	resp, err = HTTP(context.Background(), do("/"), &Options{MaxRetry: 1, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Len(t, bodies, 2)
+	require.True(t, bodies[0].closed)
+	require.False(t, bodies[1].closed)
+	resp.Body.Close()
+}
+
+func TestHTTPServerErrors(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	// 500 Internal Server Error is retried like the other transient 5xx.
+	resp, err := HTTP(context.Background(), func() (*http.Response, error) {
+		return http.Get(server.URL)
+	}, &Options{MaxRetry: 1, Clock: newFakeClock()})
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
@@ -0,0 +1,75 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// slogLogger adapts a StructuredLogger to Logger, for the messages which are
+// not emitted as structured records.
+type slogLogger struct {
+	logger StructuredLogger
+}
+
+func (l slogLogger) Infof(format string, args ...interface{}) {
+	l.logger.InfoContext(context.Background(), fmt.Sprintf(format, args...))
+}
+
+func (l slogLogger) Warnf(format string, args ...interface{}) {
+	l.logger.WarnContext(context.Background(), fmt.Sprintf(format, args...))
+}
+
+func (l slogLogger) Errorf(format string, args ...interface{}) {
+	l.logger.ErrorContext(context.Background(), fmt.Sprintf(format, args...))
+}
+
+// logRetry reports the upcoming retry number attempt, after delay, of the
+// attempt which failed with err.
+func (o *Options) logRetry(ctx context.Context, attempt int, delay time.Duration, err error) {
+	if o.SlogLogger == nil || o.Silent {
+		o.logger().Warnf("Failed, retrying in %s ... (%s). Error: %v", delay, o.progress(attempt), err)
+		return
+	}
+	o.SlogLogger.WarnContext(ctx, "Failed, retrying",
+		"attempt", attempt,
+		"delay", delay,
+		"error", err)
+}
+
+// logExhausted reports the exhausted retries of e at ExhaustedLogLevel.
+func (o *Options) logExhausted(ctx context.Context, e *Error) {
+	if o.SlogLogger == nil || o.Silent {
+		format, args := "Failed, giving up after %d attempts in %s. Error: %v", []interface{}{e.Attempts, e.Elapsed, e.LastErr}
+		switch o.ExhaustedLogLevel {
+		case LogInfo:
+			o.logger().Infof(format, args...)
+		case LogWarn:
+			o.logger().Warnf(format, args...)
+		case LogError:
+			o.logger().Errorf(format, args...)
+		}
+		return
+	}
+	msg, args := "Failed, giving up", []interface{}{"attempts", e.Attempts, "elapsed", e.Elapsed, "error", e.LastErr}
+	switch o.ExhaustedLogLevel {
+	case LogInfo:
+		o.SlogLogger.InfoContext(ctx, msg, args...)
+	case LogWarn:
+		o.SlogLogger.WarnContext(ctx, msg, args...)
+	case LogError:
+		o.SlogLogger.ErrorContext(ctx, msg, args...)
+	}
+}
+
+// logRecovered reports an operation which succeeded after retries, in
+// elapsed.
+func (o *Options) logRecovered(ctx context.Context, retries int, elapsed time.Duration) {
+	if o.SlogLogger == nil || o.Silent {
+		o.logger().Infof("Succeeded, recovered after %d retries in %s", retries, elapsed)
+		return
+	}
+	o.SlogLogger.InfoContext(ctx, "Succeeded, recovered",
+		"retries", retries,
+		"elapsed", elapsed)
+}
@@ -0,0 +1,38 @@
+//go:build go1.21
+
+package retry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStdlibSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry:   1,
+		Delay:      time.Second,
+		SlogLogger: slog.New(slog.NewJSONHandler(&buf, nil)),
+		Clock:      newFakeClock(),
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	var record map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	delete(record, "time")
+	require.Equal(t, map[string]interface{}{
+		"level":   "WARN",
+		"msg":     "Failed, retrying",
+		"attempt": float64(1),
+		"delay":   float64(time.Second),
+		"error":   "connection reset by peer",
+	}, record)
+}
@@ -0,0 +1,130 @@
+package retry
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// logRecord is a message received by a recordingLogger.
+type logRecord struct {
+	level   string
+	message string
+	attrs   map[string]interface{}
+}
+
+// recordingLogger is a StructuredLogger which keeps the records it receives.
+type recordingLogger struct {
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (l *recordingLogger) record(level, msg string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record := logRecord{level: level, message: msg, attrs: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		record.attrs[args[i].(string)] = args[i+1]
+	}
+	l.records = append(l.records, record)
+}
+
+func (l *recordingLogger) InfoContext(_ context.Context, msg string, args ...interface{}) {
+	l.record("INFO", msg, args)
+}
+
+func (l *recordingLogger) WarnContext(_ context.Context, msg string, args ...interface{}) {
+	l.record("WARN", msg, args)
+}
+
+func (l *recordingLogger) ErrorContext(_ context.Context, msg string, args ...interface{}) {
+	l.record("ERROR", msg, args)
+}
+
+func TestSlogLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry:   2,
+		Delay:      time.Second,
+		SlogLogger: logger,
+		Logger:     failingLogger{t},
+		Clock:      newFakeClock(),
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Len(t, logger.records, 2)
+	for i, record := range logger.records {
+		require.Equal(t, logRecord{
+			level:   "WARN",
+			message: "Failed, retrying",
+			attrs:   map[string]interface{}{"attempt": i + 1, "delay": time.Second, "error": syscall.ECONNRESET},
+		}, record)
+	}
+
+	// Other messages are emitted through SlogLogger too.
+	logger = &recordingLogger{}
+	err = IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{
+		MaxRetry:   2,
+		SlogLogger: logger,
+		PreRetry:   func(context.Context, int, error) bool { return false },
+	})
+	require.ErrorIs(t, err, syscall.ECONNRESET)
+	require.Len(t, logger.records, 1)
+	require.Equal(t, "WARN", logger.records[0].level)
+	require.Contains(t, logger.records[0].message, "not retrying")
+}
+
+func TestSlogLoggerExhaustedAndRecovered(t *testing.T) {
+	logger := &recordingLogger{}
+	err := IfNecessary(context.Background(), func() error {
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 1, ExhaustedLogLevel: LogError, SlogLogger: logger, Clock: newFakeClock()})
+	require.True(t, IsExhausted(err))
+	require.Len(t, logger.records, 2)
+	require.Equal(t, logRecord{
+		level:   "ERROR",
+		message: "Failed, giving up",
+		attrs:   map[string]interface{}{"attempts": 2, "elapsed": time.Second, "error": syscall.ECONNRESET},
+	}, logger.records[1])
+
+	logger = &recordingLogger{}
+	calls := 0
+	err = IfNecessary(context.Background(), func() error {
+		calls++
+		if calls == 1 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, &Options{MaxRetry: 1, LogRecovered: true, SlogLogger: logger, Clock: newFakeClock()})
+	require.NoError(t, err)
+	require.Len(t, logger.records, 2)
+	require.Equal(t, logRecord{
+		level:   "INFO",
+		message: "Succeeded, recovered",
+		attrs:   map[string]interface{}{"retries": 1, "elapsed": time.Second},
+	}, logger.records[1])
+}
+
+// failingLogger is a Logger failing the test if it is used.
+type failingLogger struct {
+	t *testing.T
+}
+
+func (l failingLogger) Infof(format string, args ...interface{}) {
+	l.t.Errorf("unexpected message: "+format, args...)
+}
+
+func (l failingLogger) Warnf(format string, args ...interface{}) {
+	l.t.Errorf("unexpected message: "+format, args...)
+}
+
+func (l failingLogger) Errorf(format string, args ...interface{}) {
+	l.t.Errorf("unexpected message: "+format, args...)
+}
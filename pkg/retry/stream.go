@@ -0,0 +1,47 @@
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+// Attempt describes an attempt of an operation retried by Stream or Plan.
+type Attempt struct {
+	Number int           // The 1-based number of the attempt.
+	Err    error         // The error of the attempt, nil if it succeeded.
+	Delay  time.Duration // The delay before the next attempt, 0 for the last one.
+}
+
+// Stream retries the operation like IfNecessaryCtx in the background, and
+// sends every attempt to the returned channel as soon as it completes.  The
+// last attempt carries the error IfNecessaryCtx would return, and the
+// channel is closed after it.  Failed attempts are reported before sleeping,
+// and the retry loop waits for them to be received, so a consumer can cancel
+// ctx depending on intermediate errors.  Once ctx is done, attempts that were
+// not received yet may be dropped.
+func Stream(ctx context.Context, operation func(ctx context.Context) error, options *Options) <-chan Attempt {
+	ch := make(chan Attempt)
+	send := func(attempt Attempt) {
+		select {
+		case ch <- attempt:
+		case <-ctx.Done():
+		}
+	}
+	streamOptions := Options{}
+	if options != nil {
+		streamOptions = *options
+	}
+	onRetry := streamOptions.OnRetry
+	streamOptions.OnRetry = func(attempt int, delay time.Duration, err error) {
+		if onRetry != nil {
+			onRetry(attempt, delay, err)
+		}
+		send(Attempt{Number: attempt, Err: err, Delay: delay})
+	}
+	go func() {
+		defer close(ch)
+		attempts, err := ifNecessary(ctx, operation, &streamOptions)
+		send(Attempt{Number: attempts, Err: err})
+	}()
+	return ch
+}
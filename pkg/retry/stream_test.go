@@ -0,0 +1,55 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStream(t *testing.T) {
+	calls := 0
+	var attempts []Attempt
+	for attempt := range Stream(context.Background(), func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return syscall.ECONNRESET
+		}
+		return nil
+	}, &Options{MaxRetry: 3, Delay: time.Second, Clock: newFakeClock()}) {
+		attempts = append(attempts, attempt)
+	}
+	require.Equal(t, []Attempt{
+		{Number: 1, Err: syscall.ECONNRESET, Delay: time.Second},
+		{Number: 2, Err: syscall.ECONNRESET, Delay: time.Second},
+		{Number: 3},
+	}, attempts)
+
+	// The consumer can stop the retries depending on an intermediate error.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls = 0
+	attempts = nil
+	for attempt := range Stream(ctx, func(context.Context) error {
+		calls++
+		return syscall.ECONNRESET
+	}, &Options{MaxRetry: 100, Delay: time.Hour}) {
+		attempts = append(attempts, attempt)
+		cancel()
+	}
+	require.Equal(t, 1, calls)
+	require.NotEmpty(t, attempts)
+	require.ErrorIs(t, attempts[0].Err, syscall.ECONNRESET)
+
+	failure := errors.New("not retryable")
+	attempts = nil
+	for attempt := range Stream(context.Background(), func(context.Context) error {
+		return failure
+	}, nil) {
+		attempts = append(attempts, attempt)
+	}
+	require.Equal(t, []Attempt{{Number: 1, Err: failure}}, attempts)
+}
@@ -0,0 +1,44 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// defaultPollInterval is the delay between the checks made by WaitForReady
+// if options do not set one.
+const defaultPollInterval = time.Second
+
+// WaitForReady polls check until it returns nil, e.g. to wait for a service
+// to start.  Unlike IfNecessary, every error returned by check is retried,
+// whatever its type, because a check legitimately fails until the wait is
+// over; check can return an error wrapped by Permanent to stop waiting.
+//
+// The options are used as in IfNecessary, with these differences: the default
+// strategy is BackoffConstant instead of BackoffExponential, with a delay of
+// 1 second if neither Delay nor BaseDelay are set, and if neither MaxRetry,
+// MaxAttempts nor MaxElapsedTime are set, check is retried until ctx is done.
+func WaitForReady(ctx context.Context, check func() error, options *Options) error {
+	waitOptions := Options{}
+	if options != nil {
+		waitOptions = *options
+	}
+	if waitOptions.Strategy == BackoffExponential {
+		waitOptions.Strategy = BackoffConstant
+	}
+	if waitOptions.Delay == 0 && waitOptions.BaseDelay == 0 {
+		waitOptions.Delay = defaultPollInterval
+	}
+	if _, limited := waitOptions.maxRetry(); !limited && waitOptions.MaxElapsedTime == 0 {
+		waitOptions.unlimited = true
+	}
+	return IfNecessary(ctx, func() error {
+		err := check()
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			return err
+		}
+		return Retryable(err)
+	}, &waitOptions)
+}
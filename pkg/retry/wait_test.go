@@ -0,0 +1,62 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForReady(t *testing.T) {
+	errStarting := errors.New("starting")
+	clock := newFakeClock()
+	calls := 0
+	err := WaitForReady(context.Background(), func() error {
+		calls++
+		if calls < 50 {
+			return errStarting
+		}
+		return nil
+	}, &Options{Clock: clock})
+	require.NoError(t, err)
+	require.Equal(t, 50, calls)
+	for _, delay := range clock.Slept() {
+		require.Equal(t, time.Second, delay)
+	}
+
+	// Limits and strategies set in the options apply.
+	clock = newFakeClock()
+	calls = 0
+	err = WaitForReady(context.Background(), func() error {
+		calls++
+		return errStarting
+	}, &Options{MaxRetry: 3, BaseDelay: time.Millisecond, Strategy: BackoffLinear, Clock: clock})
+	require.True(t, IsExhausted(err))
+	require.ErrorIs(t, err, errStarting)
+	require.Equal(t, 4, calls)
+	require.Equal(t, []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond}, clock.Slept())
+
+	// Without limits, the wait ends with ctx.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	logger, hook := test.NewNullLogger()
+	err = WaitForReady(ctx, func() error {
+		return errStarting
+	}, &Options{Delay: time.Millisecond, Logger: logger})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.ErrorIs(t, err, errStarting)
+	require.Contains(t, hook.AllEntries()[0].Message, "retrying in 1ms ... (1). Error: starting")
+
+	// Permanent errors stop the wait.
+	calls = 0
+	failure := errors.New("crashed")
+	err = WaitForReady(context.Background(), func() error {
+		calls++
+		return Permanent(failure)
+	}, nil)
+	require.Equal(t, failure, err)
+	require.Equal(t, 1, calls)
+}